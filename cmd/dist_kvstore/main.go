@@ -2,11 +2,15 @@ package main
 
 import (
 	"dist_kvstore/pkg/dist_store"
+	"dist_kvstore/pkg/paxos"
+	"dist_kvstore/pkg/rpc"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -14,6 +18,9 @@ type HostConfig struct {
 	Badger string `json:"badger"`
 	RPC    string `json:"rpc"`
 	Store  string `json:"store"`
+	Join   bool   `json:"join"` // not an acceptor until a membership change adds it
+	// RevisionWindow - number of log ids before the compacted log whose revisions are kept, the default if 0
+	RevisionWindow uint64 `json:"revision_window"`
 }
 type Config []HostConfig
 
@@ -35,14 +42,28 @@ func main() {
 
 	badgerDBPath := cl[id].Badger
 	peerAddrList := make([]string, len(cl))
+	joining := make([]int, 0)
 	for i, c := range cl {
 		peerAddrList[i] = c.RPC
+		if c.Join {
+			joining = append(joining, i)
+		}
 	}
-	ds, err := dist_store.NewStore(id, badgerDBPath, peerAddrList)
+	ds, err := dist_store.NewStore(id, badgerDBPath, peerAddrList, paxos.LogId(cl[id].RevisionWindow), joining...)
 	if err != nil {
 		panic(err)
 	}
 	defer ds.Close()
+	// load the keyring in DIST_KVSTORE_RPC_KEYRING again on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := rpc.ReloadKeyrings(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
 	go ds.ListenAndServeRPC()
 	time.Sleep(time.Second)
 
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
+	"time"
 
+	"dist_kvstore/pkg/codec"
 	"dist_kvstore/pkg/crypt"
+	"dist_kvstore/pkg/dist_store"
+	"dist_kvstore/pkg/local_store"
+	"dist_kvstore/pkg/paxos"
 	"dist_kvstore/pkg/rpc"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
 )
 
 func testRPC() {
@@ -36,9 +47,12 @@ func testRPC() {
 		}
 	})
 
-	localTransport := d.Handle
+	localTransport := rpc.NewTransport(func(ctx context.Context, b []byte) ([]byte, error) {
+		return d.Handle(b)
+	}, rpc.BINARY_CODEC)
 	{
 		res, err := rpc.RPC[AddReq, int](
+			context.Background(),
 			localTransport,
 			"add",
 			&AddReq{Values: []int{1, 2, 3}},
@@ -50,6 +64,7 @@ func testRPC() {
 	}
 	{
 		res, err := rpc.RPC[SubReq, SubRes](
+			context.Background(),
 			localTransport,
 			"sub",
 			&SubReq{A: 20, B: 16},
@@ -79,6 +94,7 @@ func testRPCTCP() {
 		Diff int
 	}
 
+	_ = os.Setenv(rpc.RPC_INSECURE_ENV, "true")
 	addr := "localhost:14001"
 	s, err := rpc.NewTCPServer(addr)
 	if err != nil {
@@ -102,9 +118,10 @@ func testRPCTCP() {
 
 	go s.ListenAndServe(d)
 
-	transport := rpc.TCPTransport(addr)
+	transport := rpc.TCPTransport("localhost:14000", addr)
 	{
 		res, err := rpc.RPC[AddReq, AddRes](
+			context.Background(),
 			transport,
 			"add",
 			&AddReq{Values: []int{1, 2, 3}},
@@ -116,6 +133,7 @@ func testRPCTCP() {
 	}
 	{
 		res, err := rpc.RPC[SubReq, SubRes](
+			context.Background(),
 			transport,
 			"sub",
 			&SubReq{A: 20, B: 16},
@@ -146,6 +164,143 @@ func testAES() {
 	fmt.Printf("Decrypted: %s\n", decrypted)
 }
 
+// checkStore - open the store in dir twice, a, b, c and d must be as written by the log in dir and the first open
+func checkStore(name string, dir string) {
+	_ = os.Setenv(rpc.RPC_INSECURE_ENV, "true")
+	check := func(want map[string]string) {
+		ds, err := dist_store.NewStore(0, dir, []string{"localhost:14002"}, 0)
+		if err != nil {
+			panic(err)
+		}
+		defer ds.Close()
+		go ds.ListenAndServeRPC()
+		for key, val := range want {
+			entry, err := ds.Get(context.Background(), key, dist_store.STALE)
+			if err != nil {
+				panic(err)
+			}
+			if string(entry.Val) != val || (len(val) == 0) != (entry.Ver == 0) {
+				panic(fmt.Sprintf("%s: %s is %q at version %d, want %q", name, key, entry.Val, entry.Ver, val))
+			}
+		}
+		if _, ok := want["d"]; !ok {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err = ds.Set(ctx, dist_store.Cmd{
+				Entries: []dist_store.Entry{dist_store.Put("d", []byte{0, 1})},
+			})
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+	check(map[string]string{"a": "hello", "b": "eA==", "c": ""})
+	check(map[string]string{"a": "hello", "b": "eA==", "c": "", "d": "\x00\x01"})
+}
+
+// testLegacyStore - open a data directory written by the baseline, where values were strings and an empty value deleted,
+// write to it and open it again
+func testLegacyStore() {
+	type Entry struct {
+		Key string `json:"key"`
+		Val string `json:"val"`
+		Ver uint64 `json:"ver"`
+	}
+	type Cmd struct {
+		Uuid    uuid.UUID `json:"uuid"`
+		Entries []Entry   `json:"entries"`
+	}
+	type Promise struct {
+		Proposal paxos.Proposal `json:"proposal"`
+		Value    *Cmd           `json:"value"`
+	}
+
+	dir, err := os.MkdirTemp("", "legacy_store")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		panic(err)
+	}
+	cmds := []Cmd{
+		{Uuid: uuid.New(), Entries: []Entry{{Key: "a", Val: "hello", Ver: 1}, {Key: "b", Val: "eA==", Ver: 1}}},
+		{Uuid: uuid.New(), Entries: []Entry{{Key: "c", Val: "x", Ver: 1}}},
+		{Uuid: uuid.New(), Entries: []Entry{{Key: "c", Val: "", Ver: 2}}},
+	}
+	log := local_store.MakeStoreFromStringStore[paxos.LogId, Promise](local_store.NewBadgerStringStore(db).Append("log"), codec.JSON)
+	log.Update(func(txn local_store.Txn[paxos.LogId, Promise]) any {
+		for i := range cmds {
+			txn.Set(paxos.LogId(i), Promise{
+				Proposal: paxos.COMMITTED,
+				Value:    &cmds[i],
+			})
+		}
+		return nil
+	})
+	if err = db.Close(); err != nil {
+		panic(err)
+	}
+
+	checkStore("legacy store", dir)
+	fmt.Println("legacy store ok")
+}
+
+// testNegotiate - requests reach a peer before protocol versions as JSON, and a peer that drops a hello is not downgraded
+func testNegotiate() {
+	type AddReq struct {
+		Values []int
+	}
+
+	d := rpc.NewDispatcher().Register("add", func(req *AddReq) (res *int) {
+		sum := 0
+		for _, v := range req.Values {
+			sum += v
+		}
+		return &sum
+	})
+	add := func(transport rpc.TransportFunc) int {
+		res, err := rpc.RPC[AddReq, int](context.Background(), transport, "add", &AddReq{Values: []int{1, 2, 3}})
+		if err != nil {
+			panic(err)
+		}
+		return *res
+	}
+
+	var requests []byte // first byte of every request frame
+	old := rpc.NewTransport(func(ctx context.Context, b []byte) ([]byte, error) {
+		if b[0] != '{' {
+			return nil, io.EOF // cannot parse it
+		}
+		requests = append(requests, b[0])
+		return d.Handle(b)
+	}, rpc.BINARY_CODEC)
+	if add(old) != 6 || add(old) != 6 || string(requests) != "{{" {
+		panic(fmt.Sprintf("requests to an old peer %q", requests))
+	}
+
+	requests, dropped := nil, false
+	flaky := rpc.NewTransport(func(ctx context.Context, b []byte) ([]byte, error) {
+		if !dropped {
+			dropped = true
+			return nil, io.EOF
+		}
+		if b[1] != rpc.CODEC_REJECTED {
+			requests = append(requests, b[0])
+		}
+		return d.Handle(b)
+	}, rpc.BINARY_CODEC)
+	if add(flaky) != 6 || string(requests) != string([]byte{rpc.PROTOCOL_VERSION}) {
+		panic(fmt.Sprintf("requests to a flaky peer %q", requests))
+	}
+	fmt.Println("negotiate ok")
+}
+
 func main() {
 	testRPC()
+	testRPCTCP()
+	testAES()
+	testNegotiate()
+	testLegacyStore()
 }
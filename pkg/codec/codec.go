@@ -0,0 +1,386 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"reflect"
+)
+
+// Codec - encoding of values in the local store and on the wire
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(b []byte, v any) error
+}
+
+var (
+	JSON   Codec = jsonCodec{}
+	BINARY Codec = binaryCodec{}
+)
+
+var errShortBuffer = errors.New("binary codec: short buffer")
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v any) error {
+	return json.Unmarshal(b, v)
+}
+
+// binaryCodec - compact encoding without field names, struct fields are encoded in the order of declaration
+// integers are variable length and their encodings sort in numeric order,
+// a string or []byte that is the whole value is not length prefixed so its encoding sorts like itself
+// hence keys that are integers or strings are in order in an ordered store
+type binaryCodec struct{}
+
+// Marshal - a pointer is encoded as the value it points to, Unmarshal decodes into the value v points to
+func (binaryCodec) Marshal(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("binary codec: marshal nil %T", v)
+		}
+		rv = rv.Elem()
+	}
+	return appendValue(nil, rv, true)
+}
+
+func (binaryCodec) Unmarshal(b []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("binary codec: unmarshal into %T", v)
+	}
+	rest, err := readValue(b, rv.Elem(), true)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("binary codec: %d trailing bytes", len(rest))
+	}
+	return nil
+}
+
+// appendBigEndian - the low n bytes of u
+func appendBigEndian(b []byte, u uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(u>>(8*i)))
+	}
+	return b
+}
+
+func readBigEndian(b []byte, n int) (uint64, []byte, error) {
+	if n > 8 || len(b) < n {
+		return 0, nil, errShortBuffer
+	}
+	u := uint64(0)
+	for _, c := range b[:n] {
+		u = u<<8 | uint64(c)
+	}
+	return u, b[n:], nil
+}
+
+// appendUint - number of significant bytes n then the n bytes
+func appendUint(b []byte, u uint64) []byte {
+	n := (bits.Len64(u) + 7) / 8
+	return appendBigEndian(append(b, byte(n)), u, n)
+}
+
+func readUint(b []byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errShortBuffer
+	}
+	return readBigEndian(b[1:], int(b[0]))
+}
+
+// appendInt - 9+n then the n significant bytes of i if i >= 0
+// 8-n then the complement of the n significant bytes of -i-1 otherwise
+func appendInt(b []byte, i int64) []byte {
+	if i >= 0 {
+		n := (bits.Len64(uint64(i)) + 7) / 8
+		return appendBigEndian(append(b, byte(9+n)), uint64(i), n)
+	}
+	u := ^uint64(i)
+	n := (bits.Len64(u) + 7) / 8
+	return appendBigEndian(append(b, byte(8-n)), ^u, n)
+}
+
+func readInt(b []byte) (int64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errShortBuffer
+	}
+	if b[0] >= 9 {
+		u, rest, err := readBigEndian(b[1:], int(b[0])-9)
+		return int64(u), rest, err
+	}
+	n := 8 - int(b[0])
+	u, rest, err := readBigEndian(b[1:], n)
+	if err != nil {
+		return 0, nil, err
+	}
+	// restore the complemented bytes above the n significant ones
+	return int64(u | ^(uint64(1)<<(8*n) - 1)), rest, nil
+}
+
+// appendLength - 0 for nil, n+1 for n elements
+func appendLength(b []byte, v reflect.Value) []byte {
+	if v.IsNil() {
+		return appendUint(b, 0)
+	}
+	return appendUint(b, uint64(v.Len())+1)
+}
+
+func readLength(b []byte) (int, bool, []byte, error) {
+	u, rest, err := readUint(b)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	if u == 0 {
+		return 0, true, rest, nil
+	}
+	if u-1 > uint64(len(rest)) {
+		return 0, false, nil, errShortBuffer // every element takes at least a byte
+	}
+	return int(u - 1), false, rest, nil
+}
+
+// appendValue - last is true if nothing follows v
+func appendValue(b []byte, v reflect.Value, last bool) ([]byte, error) {
+	var err error
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUint(b, v.Uint()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(b, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		if !last {
+			b = appendUint(b, uint64(v.Len()))
+		}
+		return append(b, v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if last {
+				// nil is 0, otherwise 1 then the bytes
+				if v.IsNil() {
+					return append(b, 0), nil
+				}
+				return append(append(b, 1), v.Bytes()...), nil
+			}
+			return append(appendLength(b, v), v.Bytes()...), nil
+		}
+		b = appendLength(b, v)
+		for i := 0; i < v.Len(); i++ {
+			if b, err = appendValue(b, v.Index(i), false); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			for i := 0; i < v.Len(); i++ {
+				b = append(b, byte(v.Index(i).Uint()))
+			}
+			return b, nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if b, err = appendValue(b, v.Index(i), false); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		b = appendLength(b, v)
+		iter := v.MapRange()
+		for iter.Next() {
+			if b, err = appendValue(b, iter.Key(), false); err != nil {
+				return nil, err
+			}
+			if b, err = appendValue(b, iter.Value(), false); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			return append(b, 0), nil
+		}
+		return appendValue(append(b, 1), v.Elem(), last)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if b, err = appendValue(b, v.Field(i), false); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("binary codec: unsupported type %s", v.Type())
+	}
+}
+
+func readValue(b []byte, v reflect.Value, last bool) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if len(b) == 0 {
+			return nil, errShortBuffer
+		}
+		v.SetBool(b[0] != 0)
+		return b[1:], nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, rest, err := readInt(b)
+		if err != nil {
+			return nil, err
+		}
+		v.SetInt(i)
+		return rest, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, rest, err := readUint(b)
+		if err != nil {
+			return nil, err
+		}
+		v.SetUint(u)
+		return rest, nil
+	case reflect.Float32:
+		if len(b) < 4 {
+			return nil, errShortBuffer
+		}
+		v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))))
+		return b[4:], nil
+	case reflect.Float64:
+		if len(b) < 8 {
+			return nil, errShortBuffer
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		return b[8:], nil
+	case reflect.String:
+		if last {
+			v.SetString(string(b))
+			return nil, nil
+		}
+		n, rest, err := readUint(b)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, errShortBuffer
+		}
+		v.SetString(string(rest[:n]))
+		return rest[n:], nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if last {
+				if len(b) == 0 {
+					return nil, errShortBuffer
+				}
+				if b[0] == 0 {
+					v.SetZero()
+				} else {
+					v.SetBytes(append(make([]byte, 0, len(b)-1), b[1:]...))
+				}
+				return nil, nil
+			}
+			n, isNil, rest, err := readLength(b)
+			if err != nil {
+				return nil, err
+			}
+			if isNil {
+				v.SetZero()
+			} else {
+				v.SetBytes(append(make([]byte, 0, n), rest[:n]...))
+			}
+			return rest[n:], nil
+		}
+		n, isNil, rest, err := readLength(b)
+		if err != nil {
+			return nil, err
+		}
+		if isNil {
+			v.SetZero()
+			return rest, nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if rest, err = readValue(rest, v.Index(i), false); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if len(b) < v.Len() {
+				return nil, errShortBuffer
+			}
+			for i := 0; i < v.Len(); i++ {
+				v.Index(i).SetUint(uint64(b[i]))
+			}
+			return b[v.Len():], nil
+		}
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if b, err = readValue(b, v.Index(i), false); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		n, isNil, rest, err := readLength(b)
+		if err != nil {
+			return nil, err
+		}
+		if isNil {
+			v.SetZero()
+			return rest, nil
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		for i := 0; i < n; i++ {
+			key, val := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+			if rest, err = readValue(rest, key, false); err != nil {
+				return nil, err
+			}
+			if rest, err = readValue(rest, val, false); err != nil {
+				return nil, err
+			}
+			v.SetMapIndex(key, val)
+		}
+		return rest, nil
+	case reflect.Pointer:
+		if len(b) == 0 {
+			return nil, errShortBuffer
+		}
+		if b[0] == 0 {
+			v.SetZero()
+			return b[1:], nil
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return readValue(b[1:], v.Elem(), last)
+	case reflect.Struct:
+		var err error
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if b, err = readValue(b, v.Field(i), false); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("binary codec: unsupported type %s", v.Type())
+	}
+}
@@ -0,0 +1,128 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type testStruct struct {
+	A int64
+	B string
+	C []byte
+	D *uint64
+	E []string
+	f int // unexported fields are not encoded
+}
+
+type testRenamed struct {
+	X int64
+	Y string
+	Z []byte
+	W *uint64
+	V []string
+}
+
+type testReordered struct {
+	B string
+	A int64
+	C []byte
+	D *uint64
+	E []string
+}
+
+func TestBinaryGolden(t *testing.T) {
+	seven := uint64(7)
+	for _, c := range []struct {
+		v   any
+		hex string
+	}{
+		{int64(0), "09"},
+		{int64(1), "0a01"},
+		{int64(-1), "08"},
+		{int64(256), "0b0100"},
+		{int64(math.MinInt64), "008000000000000000"},
+		{uint64(0), "00"},
+		{uint64(255), "01ff"},
+		{uint64(math.MaxUint64), "08ffffffffffffffff"},
+		{true, "01"},
+		{"ab", "6162"},
+		{[]byte(nil), "00"},
+		{[]byte{}, "01"},
+		{[]byte("ab"), "016162"},
+		{[]string{"a", ""}, "010301016100"},
+		{map[string]int64{"a": 1}, "01020101610a01"},
+		{testStruct{A: -2, B: "b", C: nil, D: &seven, E: nil}, "07fe0101620001010700"},
+		{testStruct{A: 0, B: "", C: []byte{}, D: nil, E: []string{}}, "09000101000101"},
+	} {
+		b, err := BINARY.Marshal(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(b) != c.hex {
+			t.Fatalf("%#v is encoded as %x, want %s", c.v, b, c.hex)
+		}
+		decoded := reflect.New(reflect.TypeOf(c.v))
+		if err = BINARY.Unmarshal(b, decoded.Interface()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded.Elem().Interface(), c.v) {
+			t.Fatalf("%x is decoded as %#v, want %#v", b, decoded.Elem().Interface(), c.v)
+		}
+	}
+}
+
+func TestBinaryOrder(t *testing.T) {
+	for _, vs := range [][]any{
+		{int64(math.MinInt64), int64(-65536), int64(-256), int64(-255), int64(-1), int64(0), int64(1), int64(255), int64(256), int64(math.MaxInt64)},
+		{uint64(0), uint64(1), uint64(255), uint64(256), uint64(65535), uint64(65536), uint64(math.MaxUint64)},
+		{"", "\x00", "a", "a\x00", "ab", "b", "\xff"},
+	} {
+		var last []byte
+		for i, v := range vs {
+			b, err := BINARY.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i > 0 && bytes.Compare(last, b) >= 0 {
+				t.Fatalf("%#v is not encoded before %#v", vs[i-1], v)
+			}
+			last = b
+		}
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	b, err := VERSIONED.Marshal(int64(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{SCHEMA_MAGIC, BINARY_SCHEMA, 0x0a, 0x01}) {
+		t.Fatalf("1 is encoded as %x", b)
+	}
+	i := int64(0)
+	if err = VERSIONED.Unmarshal(b, &i); err != nil || i != 1 {
+		t.Fatalf("%x is decoded as %d %v", b, i, err)
+	}
+	for _, b := range [][]byte{{SCHEMA_MAGIC, BINARY_SCHEMA + 1, 0x0a, 0x01}, {0x0a, 0x01}, nil} {
+		if err = VERSIONED.Unmarshal(b, &i); !errors.Is(err, ErrSchema) {
+			t.Fatalf("%x decoded with %v", b, err)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	layout := Layout(testStruct{})
+	if Layout(testRenamed{}) != layout {
+		t.Fatal("layout depends on field names")
+	}
+	if Layout(testReordered{}) == layout {
+		t.Fatal("layout does not change when fields are reordered")
+	}
+	if Layout(testStruct{}, int64(0)) == layout {
+		t.Fatal("layout does not change when a type is added")
+	}
+}
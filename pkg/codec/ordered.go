@@ -0,0 +1,46 @@
+package codec
+
+import (
+	"errors"
+	"strings"
+)
+
+// ORDERED_ESCAPE - 0x00 in an ordered string is followed by it, an unescaped 0x00 ends the string
+const ORDERED_ESCAPE byte = 0xff
+
+var errUnterminated = errors.New("ordered string: unterminated")
+
+// AppendOrderedPrefix - s with 0x00 escaped, the encodings of the strings with prefix s start with it
+func AppendOrderedPrefix(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i])
+		if s[i] == 0 {
+			b = append(b, ORDERED_ESCAPE)
+		}
+	}
+	return b
+}
+
+// AppendOrdered - s with 0x00 escaped then 0x00, so that encodings sort like the strings
+// and nothing appended after one can be read as part of s
+func AppendOrdered(b []byte, s string) []byte {
+	return append(AppendOrderedPrefix(b, s), 0)
+}
+
+// ReadOrdered - string encoded by AppendOrdered at the start of b and the bytes after it
+func ReadOrdered(b []byte) (string, []byte, error) {
+	sb := strings.Builder{}
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0 {
+			sb.WriteByte(b[i])
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == ORDERED_ESCAPE {
+			sb.WriteByte(0)
+			i++
+			continue
+		}
+		return sb.String(), b[i+1:], nil
+	}
+	return "", nil, errUnterminated
+}
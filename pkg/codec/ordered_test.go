@@ -0,0 +1,37 @@
+package codec
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOrdered(t *testing.T) {
+	ss := []string{"", "\x00", "\x00\x00", "\x00\xff", "\x01", "a", "a\x00", "a\x000", "a\x00b", "a0", "ab", "\xff"}
+	if !slices.IsSorted(ss) {
+		t.Fatal("strings are not sorted")
+	}
+	var last []byte
+	for i, s := range ss {
+		b := AppendOrdered(nil, s)
+		if i > 0 && bytes.Compare(last, b) >= 0 {
+			t.Fatalf("%q is not encoded before %q", ss[i-1], s)
+		}
+		last = b
+
+		// anything appended after the encoding is not read as part of s
+		decoded, rest, err := ReadOrdered(append(b, 0, 1))
+		if err != nil || decoded != s || !bytes.Equal(rest, []byte{0, 1}) {
+			t.Fatalf("%q is read back as %q with %x left %v", s, decoded, rest, err)
+		}
+		for _, other := range ss {
+			if bytes.HasPrefix(AppendOrdered(nil, other), AppendOrderedPrefix(nil, s)) != strings.HasPrefix(other, s) {
+				t.Fatalf("encoding of %q starting with the prefix %q disagrees with the strings", other, s)
+			}
+		}
+	}
+	if _, _, err := ReadOrdered([]byte("a\x00\xff")); err == nil {
+		t.Fatal("unterminated string read")
+	}
+}
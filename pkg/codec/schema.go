@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+)
+
+// BINARY_SCHEMA - version of the layout of the types this module encodes by BINARY
+// BINARY has no field names, a value only decodes into the types it has been encoded from,
+// so it is bumped whenever a field of an encoded type is added, removed, retyped or reordered, see Layout,
+// the tests of dist_store fail until it is and the layout and a golden encoding of the new schema are recorded
+// 1 - initial
+const (
+	BINARY_SCHEMA byte = 1
+	SCHEMA_MAGIC  byte = 0xfe // first byte of a value encoded by VERSIONED
+)
+
+// VERSIONED - BINARY with every value prefixed by SCHEMA_MAGIC and BINARY_SCHEMA
+// a value of another schema fails to decode instead of being read into the wrong fields
+var VERSIONED Codec = versionedCodec{
+	Codec:  BINARY,
+	schema: BINARY_SCHEMA,
+}
+
+// ErrSchema - the value has been encoded in another schema
+var ErrSchema = errors.New("binary codec: value of another schema")
+
+type versionedCodec struct {
+	Codec
+	schema byte
+}
+
+func (c versionedCodec) Marshal(v any) ([]byte, error) {
+	b, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{SCHEMA_MAGIC, c.schema}, b...), nil
+}
+
+func (c versionedCodec) Unmarshal(b []byte, v any) error {
+	if len(b) < 2 || b[0] != SCHEMA_MAGIC || b[1] != c.schema {
+		return fmt.Errorf("%w, expected schema %d", ErrSchema, c.schema)
+	}
+	return c.Codec.Unmarshal(b[2:], v)
+}
+
+// Layout - hash of the types of vs as BINARY encodes them, it changes whenever BINARY_SCHEMA must be bumped
+func Layout(vs ...any) uint64 {
+	sb := strings.Builder{}
+	seen := make(map[reflect.Type]int)
+	for _, v := range vs {
+		writeLayout(&sb, reflect.TypeOf(v), seen)
+		sb.WriteByte('\n')
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(sb.String()))
+	return h.Sum64()
+}
+
+// writeLayout - names do not matter to BINARY so they are left out, a struct is described once and referred to by number where it recurs
+func writeLayout(sb *strings.Builder, t reflect.Type, seen map[reflect.Type]int) {
+	switch t.Kind() {
+	case reflect.Slice:
+		sb.WriteString("[]")
+		writeLayout(sb, t.Elem(), seen)
+	case reflect.Array:
+		fmt.Fprintf(sb, "[%d]", t.Len())
+		writeLayout(sb, t.Elem(), seen)
+	case reflect.Map:
+		sb.WriteString("map[")
+		writeLayout(sb, t.Key(), seen)
+		sb.WriteByte(']')
+		writeLayout(sb, t.Elem(), seen)
+	case reflect.Pointer:
+		sb.WriteByte('*')
+		writeLayout(sb, t.Elem(), seen)
+	case reflect.Struct:
+		if n, ok := seen[t]; ok {
+			fmt.Fprintf(sb, "#%d", n)
+			return
+		}
+		seen[t] = len(seen)
+		fmt.Fprintf(sb, "#%d{", seen[t])
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			writeLayout(sb, t.Field(i).Type, seen)
+			sb.WriteByte(';')
+		}
+		sb.WriteByte('}')
+	default:
+		sb.WriteString(t.Kind().String())
+	}
+}
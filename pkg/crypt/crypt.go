@@ -12,8 +12,15 @@ import (
 type Crypt interface {
 	Encrypt(plaintext []byte) (ciphertext []byte, err error)
 	Decrypt(ciphertext []byte) (plaintext []byte, err error)
+	// Seal - encrypt plaintext and authenticate it together with ad, ad itself is not encrypted
+	Seal(plaintext []byte, ad []byte) (ciphertext []byte, err error)
+	// Open - decrypt ciphertext, fail unless it has been sealed with the same ad
+	Open(ciphertext []byte, ad []byte) (plaintext []byte, err error)
 }
 
+// NONE - no encryption, for connections that are secured otherwise
+var NONE Crypt = key(nil)
+
 func NewCrypt(s string) Crypt {
 	if len(s) == 0 {
 		fmt.Println("WARNING: no key is used")
@@ -26,6 +33,14 @@ func NewCrypt(s string) Crypt {
 type key []byte
 
 func (k key) Encrypt(plaintext []byte) (ciphertext []byte, err error) {
+	return k.Seal(plaintext, nil)
+}
+
+func (k key) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
+	return k.Open(ciphertext, nil)
+}
+
+func (k key) Seal(plaintext []byte, ad []byte) (ciphertext []byte, err error) {
 	if len(k) == 0 {
 		return plaintext, nil
 	}
@@ -47,11 +62,11 @@ func (k key) Encrypt(plaintext []byte) (ciphertext []byte, err error) {
 	}
 
 	// Seal appends the encrypted data to the nonce
-	ciphertext = aesGCM.Seal(nonce, nonce, plaintext, nil)
+	ciphertext = aesGCM.Seal(nonce, nonce, plaintext, ad)
 	return ciphertext, nil
 }
 
-func (k key) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
+func (k key) Open(ciphertext []byte, ad []byte) (plaintext []byte, err error) {
 	if len(k) == 0 {
 		return ciphertext, nil
 	}
@@ -72,7 +87,7 @@ func (k key) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err = aesGCM.Open(nil, nonce, ciphertext, nil)
+	plaintext, err = aesGCM.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,149 @@
+package crypt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KEYRING_RELOAD_INTERVAL - the file of a keyring is checked for changes at most this often
+const KEYRING_RELOAD_INTERVAL = 10 * time.Second
+
+// KeyConfig - key in the file of a keyring
+type KeyConfig struct {
+	Id          uint32 `json:"id"`
+	Key         string `json:"key"`
+	DecryptOnly bool   `json:"decrypt_only"` // until every node has the key
+}
+
+// Keyring - keys by id, the newest key that is not decrypt only encrypts and every key decrypts
+type Keyring struct {
+	path      string // empty if the keys are fixed
+	mu        sync.RWMutex
+	keys      map[uint32]Crypt
+	current   uint32
+	modTime   time.Time
+	nextCheck atomic.Int64 // unix ns
+}
+
+// StaticKeyring - keyring of the single key c with id 0
+func StaticKeyring(c Crypt) *Keyring {
+	return &Keyring{
+		path:      "",
+		mu:        sync.RWMutex{},
+		keys:      map[uint32]Crypt{0: c},
+		current:   0,
+		modTime:   time.Time{},
+		nextCheck: atomic.Int64{},
+	}
+}
+
+// LoadKeyring - keyring from the JSON list of KeyConfig at path, loaded again once it changes or by Reload
+// the keys are kept if the file cannot be loaded again
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{
+		path:      path,
+		mu:        sync.RWMutex{},
+		keys:      nil,
+		current:   0,
+		modTime:   time.Time{},
+		nextCheck: atomic.Int64{},
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	k.nextCheck.Store(time.Now().Add(KEYRING_RELOAD_INTERVAL).UnixNano())
+	return k, nil
+}
+
+func parseKeyring(b []byte) (map[uint32]Crypt, uint32, error) {
+	var configs []KeyConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, 0, err
+	}
+	keys := make(map[uint32]Crypt, len(configs))
+	current, ok := uint32(0), false
+	for _, c := range configs {
+		if len(c.Key) == 0 {
+			return nil, 0, fmt.Errorf("key %d is empty", c.Id)
+		}
+		if _, exists := keys[c.Id]; exists {
+			return nil, 0, fmt.Errorf("key %d is duplicated", c.Id)
+		}
+		keys[c.Id] = NewCrypt(c.Key)
+		if !c.DecryptOnly && (!ok || c.Id > current) {
+			current, ok = c.Id, true
+		}
+	}
+	if !ok {
+		return nil, 0, errors.New("no key to encrypt")
+	}
+	return keys, current, nil
+}
+
+// Reload - load the file again
+func (k *Keyring) Reload() error {
+	if len(k.path) == 0 {
+		return nil
+	}
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	keys, current, err := parseKeyring(b)
+	if err != nil {
+		return fmt.Errorf("keyring %s: %w", k.path, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.current, k.modTime = keys, current, info.ModTime()
+	return nil
+}
+
+// reloadIfChanged - load the file again if it has changed since it was loaded
+func (k *Keyring) reloadIfChanged() {
+	next := k.nextCheck.Load()
+	now := time.Now()
+	if len(k.path) == 0 || now.UnixNano() < next || !k.nextCheck.CompareAndSwap(next, now.Add(KEYRING_RELOAD_INTERVAL).UnixNano()) {
+		return
+	}
+	info, err := os.Stat(k.path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	k.mu.RLock()
+	changed := !info.ModTime().Equal(k.modTime)
+	k.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err = k.Reload(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Current - id and key that encrypt
+func (k *Keyring) Current() (uint32, Crypt) {
+	k.reloadIfChanged()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+// Get - key of id
+func (k *Keyring) Get(id uint32) (Crypt, bool) {
+	k.reloadIfChanged()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	c, ok := k.keys[id]
+	return c, ok
+}
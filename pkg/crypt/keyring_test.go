@@ -0,0 +1,97 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeyring - write configs to the keyring file at path
+func writeKeyring(t *testing.T, path string, configs ...KeyConfig) {
+	t.Helper()
+	b, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	writeKeyring(t, path,
+		KeyConfig{Id: 1, Key: "old", DecryptOnly: false},
+		KeyConfig{Id: 2, Key: "new", DecryptOnly: false},
+		KeyConfig{Id: 3, Key: "next", DecryptOnly: true},
+	)
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the newest key that is not decrypt only encrypts
+	id, key := k.Current()
+	if id != 2 {
+		t.Fatalf("key %d encrypts, want 2", id)
+	}
+	ciphertext, err := key.Seal([]byte("hello"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newest, _ := k.Get(2)
+	if plaintext, err := newest.Open(ciphertext, []byte("ad")); err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatalf("sealed by the current key, opened as %q %v", plaintext, err)
+	}
+	old, _ := k.Get(1)
+	if _, err = old.Open(ciphertext, []byte("ad")); err == nil {
+		t.Fatal("sealed by key 2, opened by key 1")
+	}
+
+	// a peer that still encrypts with an older key is read by it
+	ciphertext, err = NewCrypt("old").Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := old.Open(ciphertext, nil); err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatalf("sealed by an older key, opened as %q %v", plaintext, err)
+	}
+	if _, ok := k.Get(4); ok {
+		t.Fatal("unknown key id found")
+	}
+
+	// the rotated file is loaded by Reload, a file that fails to load keeps the keys
+	writeKeyring(t, path, KeyConfig{Id: 2, Key: "new", DecryptOnly: false}, KeyConfig{Id: 3, Key: "next", DecryptOnly: false})
+	if err = k.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := k.Current(); id != 3 {
+		t.Fatalf("key %d encrypts after rotation, want 3", id)
+	}
+	if _, ok := k.Get(1); ok {
+		t.Fatal("removed key 1 still decrypts")
+	}
+	writeKeyring(t, path, KeyConfig{Id: 4, Key: "", DecryptOnly: false})
+	if err = k.Reload(); err == nil {
+		t.Fatal("keyring with an empty key loaded")
+	}
+	if id, _ := k.Current(); id != 3 {
+		t.Fatalf("key %d encrypts after a failed reload, want 3", id)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	for _, s := range []string{
+		`[]`,
+		`[{"id": 1, "key": "a", "decrypt_only": true}]`,
+		`[{"id": 1, "key": "a"}, {"id": 1, "key": "b"}]`,
+		`[{"id": 1, "key": ""}]`,
+		`{}`,
+	} {
+		if _, _, err := parseKeyring([]byte(s)); err == nil {
+			t.Fatalf("keyring %s parsed", s)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package dist_store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"dist_kvstore/pkg/paxos"
+	"dist_kvstore/pkg/rpc"
+)
+
+// MAX_STALENESS - bounded reads see every write committed this long before the read
+const MAX_STALENESS = 1000 * time.Millisecond
+
+type Consistency int
+
+const (
+	// STALE - read the local state machine, it might lag behind the other nodes
+	STALE Consistency = iota
+	// BOUNDED - read the local state machine if it has caught up within MAX_STALENESS
+	BOUNDED
+	// LINEARIZABLE - read after every write committed before the read has been applied
+	LINEARIZABLE
+)
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch s {
+	case "", "stale":
+		return STALE, nil
+	case "bounded":
+		return BOUNDED, nil
+	case "linearizable":
+		return LINEARIZABLE, nil
+	default:
+		return STALE, fmt.Errorf("consistency must be stale bounded linearizable: %s", s)
+	}
+}
+
+// readIndex - ask the leader for a logId every write committed before the call is below
+// the leader this acceptor has promised is asked first, then the others, as the promise of a node
+// restarted after a failover may still name itself until the new leader reaches it
+func (ds *store) readIndex(ctx context.Context) (paxos.LogId, bool) {
+	proposal, _ := ds.acceptor.Leader()
+	members := slices.Clone(ds.Members())
+	if i := slices.IndexFunc(members, func(m Member) bool {
+		return m.Id == proposal.Proposer()
+	}); proposal != paxos.INITIAL && i > 0 {
+		members[0], members[i] = members[i], members[0]
+	}
+	for _, m := range members {
+		if m.Id == ds.id {
+			if res := ds.handleReadIndex(&readIndexRequest{}); res.Ok {
+				return res.LogId, true
+			}
+			continue
+		}
+		res, err := rpc.RPC[readIndexRequest, readIndexResponse](ctx, ds.transport(m), "read_index", &readIndexRequest{})
+		if err == nil && res.Ok {
+			return res.LogId, true
+		}
+		if ctx.Err() != nil {
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// handleReadIndex - serve the read index if this node is the recovered leader and still holds its lease
+// the index is taken before the lease is confirmed, as every write committed before the request has been started by then
+func (ds *store) handleReadIndex(req *readIndexRequest) *readIndexResponse {
+	_, members := ds.memStore.Membership()
+	ds.leaderMu.Lock()
+	leader := ds.leader
+	ok := leader != nil && leader == ds.recovered && slices.Equal(ds.leaderMembers, members)
+	ds.leaderMu.Unlock()
+	if !ok {
+		return &readIndexResponse{
+			LogId: 0,
+			Ok:    false,
+		}
+	}
+	index := max(ds.memStore.Next(), paxos.LogId(ds.writing.Load()))
+	if !leader.Leased() {
+		ctx, cancel := ds.roundCtx()
+		renewed := leader.Renew(ctx)
+		cancel()
+		if !renewed {
+			return &readIndexResponse{
+				LogId: 0,
+				Ok:    false,
+			}
+		}
+	}
+	return &readIndexResponse{
+		LogId: index,
+		Ok:    true,
+	}
+}
+
+// catchUp - wait until every write committed before the call has been applied to the local state machine
+// it reads the index from the leader and syncs up to it, it never writes to the log
+// the error wraps ErrNoQuorum if no leader serves the index until ctx is done
+func (ds *store) catchUp(ctx context.Context) error {
+	start := time.Now()
+	backoff := newBackoff(ctx)
+	for {
+		roundCtx, cancel := context.WithTimeout(ctx, ROUND_TIMEOUT)
+		readIndex, ok := ds.readIndex(roundCtx)
+		cancel()
+		if !ok {
+			if !backoff() {
+				return fmt.Errorf("%w: %w", ErrNoQuorum, ctx.Err())
+			}
+			continue
+		}
+		for ds.memStore.Next() < readIndex {
+			_, _, rpcList := ds.membership()
+			_ = paxos.Update(ctx, ds.acceptor, rpcList) // the update loop reports sync failures
+			if ds.memStore.Next() < readIndex && !backoff() {
+				// the leader commits the logIds in flight below readIndex, they have not reached this node
+				return fmt.Errorf("catch up to logId %d: %w", readIndex, ctx.Err())
+			}
+		}
+		ds.caughtUpMu.Lock()
+		if ds.caughtUp.Before(start) {
+			ds.caughtUp = start
+		}
+		ds.caughtUpMu.Unlock()
+		return nil
+	}
+}
+
+// leased - whether this node is the leader holding a lease
+// the leader has applied every write acknowledged to clients, so it reads locally while no other leader can exist
+func (ds *store) leased() bool {
+	_, members := ds.memStore.Membership()
+	ds.leaderMu.Lock()
+	defer ds.leaderMu.Unlock()
+	return ds.leader != nil && ds.leader == ds.recovered && slices.Equal(ds.leaderMembers, members) && ds.leader.Leased()
+}
+
+// read - make sure the local state machine satisfies consistency, an error if it cannot before ctx is done
+func (ds *store) read(ctx context.Context, consistency Consistency) error {
+	if consistency != STALE && ds.leased() {
+		return nil
+	}
+	switch consistency {
+	case BOUNDED:
+		ds.caughtUpMu.Lock()
+		caughtUp := ds.caughtUp
+		ds.caughtUpMu.Unlock()
+		if time.Since(caughtUp) > MAX_STALENESS {
+			return ds.catchUp(ctx)
+		}
+	case LINEARIZABLE:
+		return ds.catchUp(ctx)
+	}
+	return nil
+}
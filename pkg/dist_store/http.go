@@ -1,19 +1,239 @@
 package dist_store
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"dist_kvstore/pkg/paxos"
+
+	"github.com/google/uuid"
 )
 
+const (
+	// SCAN_LIMIT - default number of entries of a page
+	SCAN_LIMIT     = 1000
+	SCAN_LIMIT_MAX = 10000
+	// HTTP_TIMEOUT - writes respond 504 if they have not been committed by then
+	HTTP_TIMEOUT = 10 * time.Second
+	// IDEMPOTENCY_KEY - retries of a write with the same key are applied once and respond the original result
+	// keys are shared by every client, a unique id such as a random uuid must be used
+	IDEMPOTENCY_KEY = "Idempotency-Key"
+	// VERSION_HEADER - version of a value read as application/octet-stream
+	VERSION_HEADER = "X-Version"
+	OCTET_STREAM   = "application/octet-stream"
+)
+
+// scanResponse - a page of entries as of Rev, Cursor is empty on the last page
+type scanResponse struct {
+	Entries []Entry     `json:"entries"`
+	Cursor  string      `json:"cursor"`
+	Rev     paxos.LogId `json:"rev"`
+}
+
+// parseRev - logId in the query parameter rev, ok is false if it is not given
+func parseRev(r *http.Request) (paxos.LogId, bool, error) {
+	s := r.URL.Query().Get("rev")
+	if len(s) == 0 {
+		return 0, false, nil
+	}
+	logId, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return paxos.LogId(logId), true, nil
+}
+
+// handleKeys - list every key
+func handleKeys(ds DistStore, w http.ResponseWriter, r *http.Request, consistency Consistency) {
+	ctx, cancel := context.WithTimeout(r.Context(), HTTP_TIMEOUT)
+	defer cancel()
+	keys, err := ds.Keys(ctx, consistency)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	b, err := json.Marshal(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleScan - list entries in key order from start (or the cursor of the previous page) to end, or with prefix
+// every page is read as of rev, the first page is read at the revision consistency observes
+func handleScan(ds DistStore, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	consistency, err := ParseConsistency(query.Get("consistency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end := query.Get("start"), query.Get("end")
+	if prefix := query.Get("prefix"); len(prefix) > 0 {
+		start, end = prefix, PrefixEnd(prefix)
+	}
+	if cursor := query.Get("cursor"); len(cursor) > 0 {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start = string(b)
+	}
+	limit := SCAN_LIMIT
+	if s := query.Get("limit"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, SCAN_LIMIT_MAX)
+	}
+	rev, ok, err := parseRev(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), HTTP_TIMEOUT)
+	defer cancel()
+	if !ok {
+		rev, err = ds.Revision(ctx, consistency)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+	entries, more, err := ds.ScanAt(ctx, start, end, limit, rev)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	res := scanResponse{
+		Entries: entries,
+		Cursor:  "",
+		Rev:     rev,
+	}
+	if more {
+		// the next page starts right after the last key
+		res.Cursor = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].Key + "\x00"))
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// idempotent - derive the uuid of cmd from the idempotency key of a write request if any
+// keys are global so that a retry through another node or address is recognized, clients must use unique keys
+// cmd carries the digest of its payload so that a retry with another payload is rejected instead of responding the original result
+func idempotent(r *http.Request, cmd *Cmd) {
+	key := r.Header.Get(IDEMPOTENCY_KEY)
+	if len(key) == 0 {
+		return
+	}
+	cmd.Uuid = uuid.NewSHA1(uuid.Nil, []byte(key))
+	cmd.Digest = cmd.digest()
+}
+
+// versionedValue - an empty val without val_base64 deletes the key as it did before values were bytes,
+// write an empty value with "val_base64": ""
 type versionedValue struct {
-	Val string `json:"val"`
-	Ver uint64 `json:"ver"`
+	jsonVal
+	Ver   uint64  `json:"ver"`
+	TTL   int64   `json:"ttl"`
+	Lease LeaseId `json:"lease"`
+	Op    Op      `json:"op"`
+	Delta int64   `json:"delta"`
+}
+
+// txnRequest - entries are written atomically if every precondition holds
+type txnRequest struct {
+	Conds   []Cond    `json:"conds"`
+	Entries []Entry   `json:"entries"`
+	Grant   []Lease   `json:"grant"`
+	Revoke  []LeaseId `json:"revoke"`
+}
+
+// errorStatus - 503 if a quorum is unreachable, 504 if the request has not completed within HTTP_TIMEOUT
+// 410 if the revisions to read are no longer kept, 400 if a key is not valid UTF-8
+// 422 if an idempotency key is reused for another payload
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidKey), errors.Is(err, ErrInvalidMembership):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrCompacted):
+		return http.StatusGone
+	case errors.Is(err, ErrNoQuorum):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeResult - respond with the result of a command, 409 if it has not been applied
+func writeResult(w http.ResponseWriter, result Result, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Applied {
+		w.WriteHeader(http.StatusConflict)
+	}
+	_, _ = w.Write(b)
 }
 
 func HttpHandle(ds DistStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/membership/" {
+			handleMembership(ds, w, r)
+			return
+		}
+		if r.URL.Path == "/txn/" {
+			handleTxn(ds, w, r)
+			return
+		}
+		if r.URL.Path == "/lease/" {
+			handleLease(ds, w, r)
+			return
+		}
+		if r.URL.Path == "/watch/" {
+			handleWatch(ds, w, r)
+			return
+		}
+		if r.URL.Path == "/scan/" {
+			handleScan(ds, w, r)
+			return
+		}
 		if !strings.HasPrefix(r.URL.Path, "/local_store/") {
 			http.NotFound(w, r)
 			return
@@ -21,55 +241,310 @@ func HttpHandle(ds DistStore) http.HandlerFunc {
 		defer r.Body.Close()
 
 		key, _ := strings.CutPrefix(r.URL.Path, "/local_store/")
+		consistency, err := ParseConsistency(r.URL.Query().Get("consistency"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if len(key) == 0 {
-			b, err := json.Marshal(ds.Keys())
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-			_, err = w.Write(b)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
+			handleKeys(ds, w, r, consistency)
 			return
 		}
-		switch r.Method {
-		case http.MethodGet:
-			entry := ds.Get(key)
-			b, err := json.Marshal(entry)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			_, err = w.Write(b)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		case http.MethodPost, http.MethodPut:
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			v := versionedValue{}
-			err = json.Unmarshal(body, &v)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+		if !utf8.ValidString(key) {
+			http.Error(w, ErrInvalidKey.Error(), http.StatusBadRequest)
+			return
+		}
+		handleKey(ds, w, r, key, consistency)
+	}
+}
+
+// queryUint - unsigned integer in the query parameter name, 0 if it is not given
+func queryUint(r *http.Request, name string) (uint64, error) {
+	s := r.URL.Query().Get(name)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// readEntry - entry to write from a JSON body, or from a raw application/octet-stream body with ver, ttl and lease in the query
+func readEntry(r *http.Request, key string) (Entry, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return Entry{}, err
+	}
+	if r.Header.Get("Content-Type") != OCTET_STREAM {
+		v := versionedValue{}
+		err = json.Unmarshal(body, &v)
+		if err != nil {
+			return Entry{}, err
+		}
+		val, err := v.val()
+		if err != nil {
+			return Entry{}, err
+		}
+		op := v.Op
+		if op == OP_PUT && len(val) == 0 && v.ValBase64 == nil {
+			op, val = OP_DELETE, nil
+		}
+		return Entry{
+			Key:   key,
+			Val:   val,
+			Ver:   v.Ver,
+			Op:    op,
+			Delta: v.Delta,
+			TTL:   v.TTL,
+			Lease: v.Lease,
+		}, nil
+	}
+	entry := Entry{
+		Key: key,
+		Val: body,
+		Op:  Op(r.URL.Query().Get("op")),
+	}
+	if s := r.URL.Query().Get("delta"); len(s) > 0 {
+		if entry.Delta, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return Entry{}, err
+		}
+	}
+	if entry.Ver, err = queryUint(r, "ver"); err != nil {
+		return Entry{}, err
+	}
+	ttl, err := queryUint(r, "ttl")
+	if err != nil {
+		return Entry{}, err
+	}
+	lease, err := queryUint(r, "lease")
+	if err != nil {
+		return Entry{}, err
+	}
+	entry.TTL, entry.Lease = int64(ttl), LeaseId(lease)
+	return entry, nil
+}
+
+// handleKey - read, write or delete a single key
+// a client accepting application/octet-stream reads the raw value with its version in VERSION_HEADER, 404 if it is not set
+func handleKey(ds DistStore, w http.ResponseWriter, r *http.Request, key string, consistency Consistency) {
+	switch r.Method {
+	case http.MethodGet:
+		rev, ok, err := parseRev(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), HTTP_TIMEOUT)
+		defer cancel()
+		entry := Entry{}
+		if ok {
+			entry, err = ds.GetAt(ctx, key, rev)
+		} else {
+			entry, err = ds.Get(ctx, key, consistency)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		if strings.Contains(r.Header.Get("Accept"), OCTET_STREAM) {
+			if entry.Ver == 0 {
+				http.NotFound(w, r)
 				return
 			}
-			cmd := makeCmd([]Entry{
-				{
-					Key: key,
-					Val: v.Val,
-					Ver: v.Ver,
-				},
-			})
+			w.Header().Set("Content-Type", OCTET_STREAM)
+			w.Header().Set(VERSION_HEADER, strconv.FormatUint(entry.Ver, 10))
+			_, _ = w.Write(entry.Val)
+			return
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		entry := Entry{
+			Key: key,
+			Op:  OP_DELETE,
+		}
+		var err error
+		if r.Method == http.MethodDelete {
+			entry.Ver, err = queryUint(r, "ver")
+		} else {
+			entry, err = readEntry(r, key)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd := makeCmd([]Entry{entry})
+		idempotent(r, &cmd)
+
+		ctx, cancel := context.WithTimeout(r.Context(), HTTP_TIMEOUT)
+		defer cancel()
+		result, err := ds.Set(ctx, cmd)
+		writeResult(w, result, err)
+	default:
+		http.Error(w, "method must be GET POST PUT DELETE", http.StatusBadRequest)
+	}
+}
+
+func handleMembership(ds DistStore, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case http.MethodGet:
+		b, err := json.Marshal(ds.Members())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPost, http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		change := MembershipChange{}
+		err = json.Unmarshal(body, &change)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), HTTP_TIMEOUT)
+		defer cancel()
+		err = ds.ChangeMembership(ctx, change)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method must be GET POST PUT", http.StatusBadRequest)
+	}
+}
 
-			ds.Set(cmd)
-			w.WriteHeader(http.StatusOK)
-		default:
-			http.Error(w, "method must be GET POST PUT", http.StatusBadRequest)
+func handleTxn(ds DistStore, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method must be POST PUT", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := txnRequest{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cmd := makeCmd(req.Entries)
+	cmd.Conds = req.Conds
+	cmd.Grant = req.Grant
+	cmd.Revoke = req.Revoke
+	idempotent(r, &cmd)
+	ctx, cancel := context.WithTimeout(r.Context(), HTTP_TIMEOUT)
+	defer cancel()
+	result, err := ds.Set(ctx, cmd)
+	writeResult(w, result, err)
+}
+
+// handleLease - POST grants a lease, or keeps the lease with id alive, DELETE revokes it and deletes its entries
+// a lease that has already expired cannot be kept alive, 409
+func handleLease(ds DistStore, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	cmd := makeCmd(nil)
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lease := Lease{}
+		err = json.Unmarshal(body, &lease)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if lease.Id == 0 && lease.TTL <= 0 {
+			http.Error(w, "ttl must be positive", http.StatusBadRequest)
+			return
+		}
+		cmd.Grant = []Lease{lease}
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		cmd.Revoke = []LeaseId{LeaseId(id)}
+	default:
+		http.Error(w, "method must be POST PUT DELETE", http.StatusBadRequest)
+		return
+	}
+	idempotent(r, &cmd)
+	ctx, cancel := context.WithTimeout(r.Context(), HTTP_TIMEOUT)
+	defer cancel()
+	result, err := ds.Set(ctx, cmd)
+	writeResult(w, result, err)
+}
 
+// handleWatch - stream changes of keys with prefix as server-sent events from the logId in from
+// a reconnecting client resumes after the id in Last-Event-ID, 410 if those changes are no longer kept
+func handleWatch(ds DistStore, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	from := ds.Next()
+	if s := query.Get("from"); len(s) > 0 {
+		logId, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = paxos.LogId(logId)
+	}
+	if s := r.Header.Get("Last-Event-ID"); len(s) > 0 {
+		logId, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = paxos.LogId(logId) + 1
+	}
+	events, err := ds.Watch(r.Context(), query.Get("prefix"), from)
+	if errors.Is(err, ErrCompacted) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.LogId, b)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
 	}
 }
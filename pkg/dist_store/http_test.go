@@ -0,0 +1,65 @@
+package dist_store
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEntryJSON(t *testing.T) {
+	for _, val := range [][]byte{nil, {}, []byte("hello"), {0xff, 0x00}} {
+		b, err := json.Marshal(Put("k", val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := Entry{}
+		if err = json.Unmarshal(b, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(entry.Val, val) {
+			t.Fatalf("%q is read back from %s as %q", val, b, entry.Val)
+		}
+	}
+	b, _ := json.Marshal(Put("k", []byte("hello")))
+	if !strings.Contains(string(b), `"val":"hello"`) {
+		t.Fatalf("a UTF-8 value is not a string in %s", b)
+	}
+	b, _ = json.Marshal(Put("k", []byte{0xff}))
+	if !strings.Contains(string(b), `"val_base64":"/w=="`) {
+		t.Fatalf("a binary value is not base64 in %s", b)
+	}
+	if err := json.Unmarshal([]byte(`{"key":"k","val":"a","val_base64":"YQ=="}`), &Entry{}); err == nil {
+		t.Fatal("both val and val_base64 accepted")
+	}
+
+	cond := Cond{}
+	if err := json.Unmarshal([]byte(`{"key":"k"}`), &cond); err != nil || cond.Val != nil {
+		t.Fatalf("condition without val has value %q %v", cond.Val, err)
+	}
+	if err := json.Unmarshal([]byte(`{"key":"k","val":""}`), &cond); err != nil || cond.Val == nil {
+		t.Fatalf("condition on the empty value has no value %v", err)
+	}
+}
+
+func TestReadEntry(t *testing.T) {
+	for body, want := range map[string]Entry{
+		`{"val": "hello", "ver": 2}`:         {Key: "k", Val: []byte("hello"), Ver: 2, Op: OP_PUT},
+		`{"val": "", "ver": 3}`:              {Key: "k", Val: nil, Ver: 3, Op: OP_DELETE},
+		`{"ver": 3}`:                         {Key: "k", Val: nil, Ver: 3, Op: OP_DELETE},
+		`{"val_base64": "", "ver": 3}`:       {Key: "k", Val: []byte{}, Ver: 3, Op: OP_PUT},
+		`{"val_base64": "/w==", "ver": 0}`:   {Key: "k", Val: []byte{0xff}, Ver: 0, Op: OP_PUT},
+		`{"op": "increment", "delta": 1}`:    {Key: "k", Val: nil, Ver: 0, Op: OP_INCREMENT, Delta: 1},
+		`{"val": "", "op": "put_if_absent"}`: {Key: "k", Val: []byte{}, Ver: 0, Op: OP_PUT_IF_ABSENT},
+	} {
+		entry, err := readEntry(httptest.NewRequest("PUT", "/local_store/k", strings.NewReader(body)), "k")
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if entry.Key != want.Key || !bytes.Equal(entry.Val, want.Val) || (entry.Val == nil) != (want.Val == nil) ||
+			entry.Ver != want.Ver || entry.Op != want.Op || entry.Delta != want.Delta {
+			t.Fatalf("%s is read as %+v, want %+v", body, entry, want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package dist_store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"dist_kvstore/pkg/local_store"
+	"dist_kvstore/pkg/paxos"
+)
+
+const (
+	// keys of leases and expiry in the StringStore of the state machine
+	STATE_LEASE      = "lease/"          // leases by id
+	STATE_LEASE_KEYS = "lease_keys/"     // lease_keys/<id>/<key> for every entry attached to a lease
+	STATE_EXPIRE     = "expire/"         // expire/<unix milli>/kv/<key> and expire/<unix milli>/lease/<id> in order of expiry
+	STATE_TIME       = "meta/time"       // committed time in unix milliseconds
+	STATE_LEASE_NEXT = "meta/lease_next" // id of the next granted lease
+
+	// EXPIRE_BATCH_SIZE - maximal number of entries and leases expired by a single log entry
+	EXPIRE_BATCH_SIZE = 1024
+)
+
+// LeaseId - id of a lease, 0 is no lease
+type LeaseId uint64
+
+// Lease - entries attached to a lease are deleted when it expires or is revoked
+// a lease is kept alive by granting it again before it expires
+type Lease struct {
+	Id     LeaseId `json:"id"`               // 0 grants a new lease
+	TTL    int64   `json:"ttl"`              // milliseconds the lease lives after it is granted, 0 keeps the current TTL on renewal
+	Expire int64   `json:"expire,omitempty"` // committed time in unix milliseconds the lease expires at, set by the state machine
+}
+
+func leaseKey(id LeaseId) string {
+	return fmt.Sprintf("%s%020d", STATE_LEASE, id)
+}
+
+func leaseKeysPrefix(id LeaseId) string {
+	return fmt.Sprintf("%s%020d/", STATE_LEASE_KEYS, id)
+}
+
+func expirePrefix(expire int64) string {
+	return fmt.Sprintf("%s%020d/", STATE_EXPIRE, expire)
+}
+
+// committedTime - advance the committed time at logId to the time proposed by the leader, it never goes back
+// the time before is kept at revisionTimeKey(logId) for reads as of earlier logIds
+func committedTime(txn local_store.Txn[string, string], logId paxos.LogId, proposed int64) int64 {
+	now, _ := getJSON[int64](txn, STATE_TIME)
+	if proposed > now {
+		setJSON(txn, revisionTimeKey(logId), now)
+		now = proposed
+		setJSON(txn, STATE_TIME, now)
+	}
+	return now
+}
+
+// setLease - write a lease, its expiry and its revision at logId
+func setLease(txn local_store.Txn[string, string], logId paxos.LogId, lease Lease) {
+	if old, ok := getJSON[Lease](txn, leaseKey(lease.Id)); ok {
+		txn.Del(expirePrefix(old.Expire) + leaseKey(lease.Id))
+	}
+	setJSON(txn, leaseKey(lease.Id), lease)
+	txn.Set(expirePrefix(lease.Expire)+leaseKey(lease.Id), "")
+	setJSON(txn, leaseRevisionKey(lease.Id, logId), lease)
+}
+
+// grantLease - grant a new lease or renew an existing one from now at logId, false if the lease to renew does not exist
+func grantLease(txn local_store.Txn[string, string], logId paxos.LogId, lease Lease, now int64) (Lease, bool) {
+	if lease.Id == 0 {
+		next, _ := getJSON[LeaseId](txn, STATE_LEASE_NEXT)
+		lease.Id = max(next, 1)
+		setJSON(txn, STATE_LEASE_NEXT, lease.Id+1)
+	} else {
+		old, ok := getJSON[Lease](txn, leaseKey(lease.Id))
+		if !ok {
+			return Lease{}, false
+		}
+		if lease.TTL == 0 {
+			lease.TTL = old.TTL
+		}
+	}
+	lease.Expire = now + lease.TTL
+	setLease(txn, logId, lease)
+	return lease, true
+}
+
+// revokeLease - delete a lease and the entries attached to it, return the deleted entries
+func revokeLease(txn local_store.Txn[string, string], logId paxos.LogId, id LeaseId) []Entry {
+	lease, ok := getJSON[Lease](txn, leaseKey(id))
+	if !ok {
+		return nil
+	}
+	txn.Del(leaseKey(id))
+	txn.Del(expirePrefix(lease.Expire) + leaseKey(id))
+	setJSON(txn, leaseRevisionKey(id, logId), Lease{
+		Id:     id,
+		TTL:    lease.TTL,
+		Expire: 0,
+	})
+	prefix := leaseKeysPrefix(id)
+	keys := make([]string, 0)
+	txn.(local_store.OrderedTxn[string, string]).Scan(prefix, func(k string, v string) bool {
+		if !strings.HasPrefix(k, prefix) {
+			return false
+		}
+		keys = append(keys, strings.TrimPrefix(k, prefix))
+		return true
+	})
+	return deleteEntries(txn, logId, keys)
+}
+
+func deleteEntries(txn local_store.Txn[string, string], logId paxos.LogId, keys []string) []Entry {
+	entries := entryTxn{txn, logId}
+	deleted := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		entry, ok := entries.Get(key)
+		if !ok {
+			continue
+		}
+		deletion := Entry{
+			Key: key,
+			Val: nil,
+			Ver: entry.Ver + 1,
+			Op:  OP_DELETE,
+		}
+		entries.delete(deletion)
+		deleted = append(deleted, deletion)
+	}
+	return deleted
+}
+
+// live - whether neither entry nor its lease expires at or before the committed time now
+func live(txn local_store.Txn[string, string], entry Entry, now int64) bool {
+	if entry.Expire > 0 && entry.Expire <= now {
+		return false
+	}
+	if entry.Lease > 0 {
+		lease, ok := getJSON[Lease](txn, leaseKey(entry.Lease))
+		return ok && lease.Expire > now
+	}
+	return true
+}
+
+// liveTxn - entries as of the committed time now, expire deletes expired entries in batches of EXPIRE_BATCH_SIZE
+// and they are unset until then
+type liveTxn struct {
+	entryTxn
+	now int64
+}
+
+func (t liveTxn) Get(key string) (Entry, bool) {
+	entry, ok := t.entryTxn.Get(key)
+	if !ok || !live(t.txn, entry, t.now) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// expire - delete entries and revoke leases that expire at or before now, return the deleted entries
+func expire(txn local_store.Txn[string, string], logId paxos.LogId, now int64) []Entry {
+	keys, leases := make([]string, 0), make([]LeaseId, 0)
+	txn.(local_store.OrderedTxn[string, string]).Scan(STATE_EXPIRE, func(k string, v string) bool {
+		at, name, ok := parseExpireKey(k)
+		if !ok || at > now || len(keys)+len(leases) >= EXPIRE_BATCH_SIZE {
+			return false
+		}
+		if key, ok := strings.CutPrefix(name, STATE_ENTRY); ok {
+			keys = append(keys, key)
+		} else if id, ok := strings.CutPrefix(name, STATE_LEASE); ok {
+			n, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				panic(err)
+			}
+			leases = append(leases, LeaseId(n))
+		}
+		return true
+	})
+	deleted := deleteEntries(txn, logId, keys)
+	for _, id := range leases {
+		deleted = append(deleted, revokeLease(txn, logId, id)...)
+	}
+	return deleted
+}
+
+// parseExpireKey - split expire/<unix milli>/<name>
+func parseExpireKey(k string) (int64, string, bool) {
+	rest, ok := strings.CutPrefix(k, STATE_EXPIRE)
+	if !ok {
+		return 0, "", false
+	}
+	at, name, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, "", false
+	}
+	n, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return n, name, true
+}
+
+// Expiring - whether an entry or a lease expires at or before now, the leader then writes a command to advance the committed time
+func (sm *stateMachine) Expiring(now int64) bool {
+	return sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		expiring := false
+		txn.(local_store.OrderedTxn[string, string]).Scan(STATE_EXPIRE, func(k string, v string) bool {
+			at, _, ok := parseExpireKey(k)
+			expiring = ok && at <= now
+			return false
+		})
+		return expiring
+	}).(bool)
+}
@@ -0,0 +1,73 @@
+package dist_store
+
+import (
+	"dist_kvstore/pkg/paxos"
+
+	"github.com/google/uuid"
+)
+
+// legacyEntry - entry in a log written by the baseline, the value was a string and an empty value meant a deletion
+type legacyEntry struct {
+	Key string `json:"key"`
+	Val string `json:"val"`
+	Ver uint64 `json:"ver"`
+}
+
+func (e legacyEntry) entry() Entry {
+	if len(e.Val) == 0 {
+		return Entry{
+			Key: e.Key,
+			Val: nil,
+			Ver: e.Ver,
+			Op:  OP_DELETE,
+		}
+	}
+	return Entry{
+		Key: e.Key,
+		Val: []byte(e.Val),
+		Ver: e.Ver,
+		Op:  OP_PUT,
+	}
+}
+
+// legacyCmd - Cmd in a log written by the baseline
+type legacyCmd struct {
+	Uuid    uuid.UUID     `json:"uuid"`
+	Entries []legacyEntry `json:"entries"`
+}
+
+func (c legacyCmd) cmd() Cmd {
+	entries := make([]Entry, 0, len(c.Entries))
+	for _, e := range c.Entries {
+		entries = append(entries, e.entry())
+	}
+	return Cmd{
+		Uuid:       c.Uuid,
+		Conds:      nil,
+		Entries:    entries,
+		Grant:      nil,
+		Revoke:     nil,
+		Time:       0,
+		Snapshot:   nil,
+		Membership: nil,
+		Batch:      nil,
+		Digest:     nil,
+	}
+}
+
+// legacyPromise - log entry written by the baseline, which had no Accepted, a value was accepted at Proposal
+func legacyPromise(p paxos.Promise[legacyCmd]) paxos.Promise[Cmd] {
+	promise := paxos.Promise[Cmd]{
+		Proposal: p.Proposal,
+		Accepted: p.Accepted,
+		Value:    nil,
+	}
+	if p.Value != nil {
+		cmd := p.Value.cmd()
+		promise.Value = &cmd
+		if promise.Accepted == paxos.INITIAL {
+			promise.Accepted = p.Proposal
+		}
+	}
+	return promise
+}
@@ -0,0 +1,177 @@
+package dist_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"dist_kvstore/pkg/paxos"
+	"dist_kvstore/pkg/rpc"
+)
+
+type Member struct {
+	Id   paxos.ProposerId `json:"id"`
+	Addr string           `json:"addr"`
+}
+
+// MembershipChange - add and remove acceptors, it takes effect from the logId after the one it is committed at
+// an acceptor is replaced by removing it and adding a new one with a different id in the same change,
+// an id must never be reused since the new acceptor does not keep the promises of the old one
+type MembershipChange struct {
+	Add    []Member           `json:"add"`
+	Remove []paxos.ProposerId `json:"remove"`
+}
+
+// ErrInvalidMembership - the change removes an acceptor that is not a member or every acceptor,
+// or adds an id or an address that is in use
+var ErrInvalidMembership = errors.New("invalid membership change")
+
+// apply - acceptors after change, ErrInvalidMembership if change is invalid for members
+// ids of acceptors removed before are not known here, they must not be reused all the same
+func (change MembershipChange) apply(members []Member) ([]Member, error) {
+	for _, id := range change.Remove {
+		if !containsMember(members, id) {
+			return nil, fmt.Errorf("%w: %d is not an acceptor", ErrInvalidMembership, id)
+		}
+	}
+	newMembers := make([]Member, 0, len(members)+len(change.Add))
+	for _, m := range members {
+		if !slices.Contains(change.Remove, m.Id) {
+			newMembers = append(newMembers, m)
+		}
+	}
+	for _, m := range change.Add {
+		if slices.ContainsFunc(members, func(o Member) bool {
+			return o.Id == m.Id
+		}) || containsMember(newMembers, m.Id) {
+			return nil, fmt.Errorf("%w: id %d is in use", ErrInvalidMembership, m.Id)
+		}
+		if slices.ContainsFunc(newMembers, func(o Member) bool {
+			return o.Addr == m.Addr
+		}) {
+			return nil, fmt.Errorf("%w: address %s is in use", ErrInvalidMembership, m.Addr)
+		}
+		newMembers = append(newMembers, m)
+	}
+	if len(newMembers) == 0 {
+		return nil, fmt.Errorf("%w: no acceptor is left", ErrInvalidMembership)
+	}
+	slices.SortFunc(newMembers, func(a, b Member) int {
+		return int(a.Id) - int(b.Id)
+	})
+	return newMembers, nil
+}
+
+func containsMember(members []Member, id paxos.ProposerId) bool {
+	return slices.ContainsFunc(members, func(m Member) bool {
+		return m.Id == id
+	})
+}
+
+// newServer - TLS server and transport if TLS is configured in the environment, otherwise those encrypted by the shared key
+// the TLS server only accepts the current acceptors, a certificate names the id of its acceptor
+func newServer(bindAddr string, memStore *stateMachine) (rpc.TCPServer, func(member Member) rpc.TransportFunc, error) {
+	config, err := rpc.TLSConfigFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if config == nil {
+		server, err := rpc.NewTCPServer(bindAddr)
+		return server, func(member Member) rpc.TransportFunc {
+			return rpc.TCPTransport(bindAddr, member.Addr)
+		}, err
+	}
+	server, err := rpc.NewTLSServer(bindAddr, config, func() []rpc.TLSPeer {
+		_, members := memStore.Membership()
+		peers := make([]rpc.TLSPeer, 0, len(members))
+		for _, m := range members {
+			peers = append(peers, m.tlsPeer())
+		}
+		return peers
+	})
+	return server, func(member Member) rpc.TransportFunc {
+		return rpc.TLSTransport(bindAddr, member.tlsPeer(), config)
+	}, err
+}
+
+// tlsPeer - the certificate of m must name its id
+func (m Member) tlsPeer() rpc.TLSPeer {
+	return rpc.TLSPeer{
+		Name: strconv.FormatUint(uint64(m.Id), 10),
+		Addr: m.Addr,
+	}
+}
+
+func (ds *store) makeRPC(member Member) paxos.RPC {
+	if member.Id == ds.id {
+		return func(ctx context.Context, req paxos.Request, resCh chan<- paxos.Response) {
+			resCh <- ds.handleRPC(req)
+		}
+	}
+	return func(ctx context.Context, req paxos.Request, resCh chan<- paxos.Response) {
+		transport := ds.transport(member)
+		res, err := func() (paxos.Response, error) {
+			switch req := req.(type) {
+			case *paxos.PrepareRequest:
+				return rpc.RPC[paxos.PrepareRequest, paxos.PrepareResponse[Cmd]](ctx, transport, "prepare", req)
+			case *paxos.AcceptRequest[Cmd]:
+				return rpc.RPC[paxos.AcceptRequest[Cmd], paxos.AcceptResponse[Cmd]](ctx, transport, "accept", req)
+			case *paxos.CommitRequest[Cmd]:
+				return rpc.RPC[paxos.CommitRequest[Cmd], paxos.CommitResponse](ctx, transport, "commit", req)
+			case *paxos.PollRequest:
+				return rpc.RPC[paxos.PollRequest, paxos.PollResponse[Cmd]](ctx, transport, "poll", req)
+			case *paxos.SyncRequest:
+				return rpc.RPC[paxos.SyncRequest, paxos.SyncResponse[Cmd]](ctx, transport, "sync", req)
+			case *paxos.NextRequest:
+				return rpc.RPC[paxos.NextRequest, paxos.NextResponse](ctx, transport, "next", req)
+			case *paxos.LeadRequest:
+				return rpc.RPC[paxos.LeadRequest, paxos.LeadResponse[Cmd]](ctx, transport, "lead", req)
+			default:
+				return nil, nil
+			}
+		}()
+		if err != nil {
+			res = nil
+		}
+		resCh <- res
+	}
+}
+
+func (ds *store) makeRPCList(members []Member) []paxos.RPC {
+	rpcList := make([]paxos.RPC, 0, len(members))
+	for _, m := range members {
+		rpcList = append(rpcList, ds.makeRPC(m))
+	}
+	return rpcList
+}
+
+// membership - get the smallest unapplied logId, the acceptors that decide it and their rpcList
+func (ds *store) membership() (paxos.LogId, []Member, []paxos.RPC) {
+	next, members := ds.memStore.Membership()
+	return next, members, ds.makeRPCList(members)
+}
+
+func (ds *store) Members() []Member {
+	_, members := ds.memStore.Membership()
+	return members
+}
+
+// ChangeMembership - ErrInvalidMembership if change is invalid for the current acceptors,
+// or for those when it is committed after a concurrent change
+func (ds *store) ChangeMembership(ctx context.Context, change MembershipChange) error {
+	if _, err := change.apply(ds.Members()); err != nil {
+		return err
+	}
+	cmd := makeCmd(nil)
+	cmd.Membership = &change
+	result, err := ds.Set(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if !result.Applied {
+		return fmt.Errorf("%w: it conflicts with a concurrent change", ErrInvalidMembership)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package dist_store
+
+import (
+	"context"
+	"time"
+
+	"dist_kvstore/pkg/paxos"
+)
+
+const (
+	// MAX_BATCH_SIZE - maximal number of commands coalesced into a single log entry
+	MAX_BATCH_SIZE = 256
+	// MAX_INFLIGHT - maximal number of logIds the leader writes at the same time
+	MAX_INFLIGHT = 8
+)
+
+// pending - command waiting to be written by the leader
+// a barrier is written alone once nothing else is in flight, membership changes are barriers
+// so that the membership of every logId in flight is known
+type pending struct {
+	cmd     Cmd
+	barrier bool
+	done    chan bool // false if cmd has not been written, its result is delivered through ds.results once applied
+}
+
+// propose - queue cmd to be written if this node is the leader, return the result of cmd once it has been applied
+func (ds *store) propose(ctx context.Context, cmd Cmd) (Result, bool) {
+	p := &pending{
+		cmd:     cmd,
+		barrier: cmd.Membership != nil,
+		done:    make(chan bool, 1),
+	}
+	ds.appliedMu.Lock()
+	ds.results[cmd.Uuid] = nil
+	ds.appliedMu.Unlock()
+	defer func() {
+		ds.appliedMu.Lock()
+		delete(ds.results, cmd.Uuid)
+		ds.appliedMu.Unlock()
+	}()
+	select {
+	case <-ctx.Done():
+		return Result{}, false
+	case <-ds.updateCtx.Done():
+		return Result{}, false
+	case ds.queue <- p:
+	}
+	select {
+	case <-ctx.Done():
+		return Result{}, false
+	case <-ds.updateCtx.Done():
+		return Result{}, false
+	case ok := <-p.done:
+		if !ok {
+			return Result{}, false
+		}
+		ds.appliedMu.Lock()
+		result := ds.results[cmd.Uuid]
+		ds.appliedMu.Unlock()
+		if result == nil {
+			return Result{}, false // store has been closed before cmd was applied
+		}
+		return *result, true
+	}
+}
+
+// proposeLoop - coalesce queued commands and write them with up to MAX_INFLIGHT logIds in flight
+func (ds *store) proposeLoop() {
+	var held *pending // barrier taken from the queue while collecting a batch
+	for {
+		p := held
+		held = nil
+		if p == nil {
+			select {
+			case <-ds.updateCtx.Done():
+				return
+			case p = <-ds.queue:
+			}
+		}
+		if p.barrier {
+			ds.writeBarrier(p)
+			continue
+		}
+		batch := []*pending{p}
+	collect:
+		for len(batch) < MAX_BATCH_SIZE {
+			select {
+			case q := <-ds.queue:
+				if q.barrier {
+					held = q
+					break collect
+				}
+				batch = append(batch, q)
+			default:
+				break collect
+			}
+		}
+		ds.writeBatch(batch)
+	}
+}
+
+func respond(batch []*pending, ok bool) {
+	for _, p := range batch {
+		p.done <- ok
+	}
+}
+
+// drain - wait until nothing is in flight and block new writes
+func (ds *store) drain() {
+	for i := 0; i < MAX_INFLIGHT; i++ {
+		ds.inflight <- struct{}{}
+	}
+}
+
+func (ds *store) undrain() {
+	for i := 0; i < MAX_INFLIGHT; i++ {
+		<-ds.inflight
+	}
+}
+
+func (ds *store) writeBarrier(p *pending) {
+	ds.drain()
+	ok := ds.writeNext(p.cmd)
+	ds.undrain()
+	respond([]*pending{p}, ok)
+}
+
+// writeBatch - write batch at the next logId without waiting for logIds in flight
+func (ds *store) writeBatch(batch []*pending) {
+	_, members := ds.memStore.Membership()
+	leader := ds.getLeader(members)
+	if leader == nil {
+		respond(batch, false)
+		return
+	}
+	if !ds.isRecovered(leader) {
+		// values accepted under previous proposals must be written before anything is pipelined
+		ds.drain()
+		ok := ds.writeNext(makeCmd(nil))
+		ds.undrain()
+		if !ok {
+			respond(batch, false)
+			return
+		}
+		_, members = ds.memStore.Membership()
+		leader = ds.getLeader(members)
+		if leader == nil || !ds.isRecovered(leader) {
+			respond(batch, false)
+			return
+		}
+	}
+	cmds := make([]Cmd, 0, len(batch))
+	for _, p := range batch {
+		cmds = append(cmds, p.cmd)
+	}
+	cmd := makeBatchCmd(cmds)
+	cmd.Time = time.Now().UnixMilli()
+
+	ds.inflight <- struct{}{}
+	logId := max(ds.nextLogId, ds.acceptor.Next())
+	ds.nextLogId = logId + 1
+	ds.startWrite(logId)
+	ds.updateWg.Add(1)
+	go func() {
+		defer ds.updateWg.Done()
+		ctx, cancel := ds.roundCtx()
+		value, ok := leader.Write(ctx, logId, cmd)
+		cancel()
+		<-ds.inflight
+		if ok && value.Equal(cmd) {
+			ds.waitApplied(ds.updateCtx, logId)
+			respond(batch, true)
+			return
+		}
+		if _, committed := ds.acceptor.GetValue(logId); !committed && logId >= ds.acceptor.First() {
+			ds.stepDown(leader)
+		}
+		respond(batch, false)
+	}()
+}
+
+func (ds *store) isRecovered(leader *paxos.Leader[Cmd]) bool {
+	ds.leaderMu.Lock()
+	defer ds.leaderMu.Unlock()
+	return leader == ds.recovered
+}
+
+// writeNext - write cmd at the smallest unapplied logId, nothing else may be in flight
+// then write empty commands until values accepted under previous proposals have been written
+func (ds *store) writeNext(cmd Cmd) bool {
+	written := false
+	for {
+		logId := ds.acceptor.Next()
+		next, members := ds.memStore.Membership()
+		if next != logId {
+			continue // applied in the meantime
+		}
+		leader := ds.getLeader(members)
+		if leader == nil {
+			return false
+		}
+		if written && !leader.Recovering(logId) {
+			ds.leaderMu.Lock()
+			ds.recovered = leader
+			ds.leaderMu.Unlock()
+			ds.nextLogId = logId
+			return true
+		}
+		value := cmd
+		if written {
+			value = makeCmd(nil)
+		}
+		value.Time = time.Now().UnixMilli()
+		ds.startWrite(logId)
+		ctx, cancel := ds.roundCtx()
+		v, ok := leader.Write(ctx, logId, value)
+		cancel()
+		if ok {
+			if !written && v.Equal(cmd) {
+				written = true
+			}
+			continue
+		}
+		if _, committed := ds.acceptor.GetValue(logId); committed || logId < ds.acceptor.First() {
+			continue
+		}
+		ds.stepDown(leader)
+		return false
+	}
+}
+
+// startWrite - record that the leader writes at logId, before any accept request is sent
+func (ds *store) startWrite(logId paxos.LogId) {
+	for {
+		v := ds.writing.Load()
+		if v > uint64(logId) || ds.writing.CompareAndSwap(v, uint64(logId)+1) {
+			return
+		}
+	}
+}
+
+// apply - apply a committed command, keep the results callers are waiting for and wake them up
+func (ds *store) apply(logId paxos.LogId, cmd Cmd) {
+	o := ds.memStore.Apply(logId, cmd)
+	ds.publish(logId, o)
+	ds.appliedMu.Lock()
+	for id, result := range o.results {
+		if _, ok := ds.results[id]; ok {
+			ds.results[id] = &result
+		}
+	}
+	close(ds.applied)
+	ds.applied = make(chan struct{})
+	ds.appliedMu.Unlock()
+}
+
+// waitApplied - wait until logId has been applied so that the caller reads its own write, false if ctx is done before
+func (ds *store) waitApplied(ctx context.Context, logId paxos.LogId) bool {
+	for {
+		ds.appliedMu.Lock()
+		applied := ds.applied
+		ds.appliedMu.Unlock()
+		if ds.memStore.Next() > logId {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ds.updateCtx.Done():
+			return false
+		case <-applied:
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package dist_store
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"dist_kvstore/pkg/codec"
+	"dist_kvstore/pkg/local_store"
+	"dist_kvstore/pkg/paxos"
+)
+
+const (
+	// keys of revisions in the StringStore of the state machine
+	STATE_REVISION       = "rev/"               // rev/<ordered key><logId> is the entry of key written at logId, OP_DELETE if deleted
+	STATE_REVISION_FROM  = "meta/revision_from" // reads as of an earlier logId are no longer possible
+	STATE_REVISION_TIME  = "revtime/"           // revtime/<logId> is the committed time before it advanced at logId
+	STATE_LEASE_REVISION = "revlease/"          // revlease/<id>/<logId> is the lease granted at logId, Expire 0 if revoked
+
+	// REVISION_WINDOW - default number of logIds before the compacted log whose revisions are kept
+	REVISION_WINDOW = 4096
+	// PRUNE_BATCH_SIZE - number of revisions visited by a single transaction while pruning
+	PRUNE_BATCH_SIZE = 4096
+)
+
+// revisionPrefix - the key is encoded by codec.AppendOrdered so that revisions sort by key then logId
+// and no key is a prefix of another
+func revisionPrefix(key string) string {
+	return STATE_REVISION + string(codec.AppendOrdered(nil, key))
+}
+
+func revisionKey(key string, logId paxos.LogId) string {
+	return fmt.Sprintf("%s%020d", revisionPrefix(key), logId)
+}
+
+func leaseRevisionPrefix(id LeaseId) string {
+	return fmt.Sprintf("%s%020d/", STATE_LEASE_REVISION, id)
+}
+
+func leaseRevisionKey(id LeaseId, logId paxos.LogId) string {
+	return fmt.Sprintf("%s%020d", leaseRevisionPrefix(id), logId)
+}
+
+func revisionTimeKey(logId paxos.LogId) string {
+	return fmt.Sprintf("%s%020d", STATE_REVISION_TIME, logId)
+}
+
+// timeAt - committed time as of logId, the time before the first advance after logId or the current one
+func timeAt(txn local_store.Txn[string, string], logId paxos.LogId) int64 {
+	now, _ := getJSON[int64](txn, STATE_TIME)
+	txn.(local_store.OrderedTxn[string, string]).Scan(revisionTimeKey(logId+1), func(k string, v string) bool {
+		if strings.HasPrefix(k, STATE_REVISION_TIME) {
+			err := json.Unmarshal([]byte(v), &now)
+			if err != nil {
+				panic(err)
+			}
+		}
+		return false
+	})
+	return now
+}
+
+// leaseAt - lease id as of logId, false if it has not been granted or has been revoked by then
+func leaseAt(txn local_store.Txn[string, string], id LeaseId, logId paxos.LogId) (Lease, bool) {
+	prefix := leaseRevisionPrefix(id)
+	lease := Lease{}
+	txn.(local_store.OrderedTxn[string, string]).Scan(prefix, func(k string, v string) bool {
+		_, rev, ok := parseLeaseRevisionKey(k)
+		if !ok || !strings.HasPrefix(k, prefix) || rev > logId {
+			return false
+		}
+		err := json.Unmarshal([]byte(v), &lease)
+		if err != nil {
+			panic(err)
+		}
+		return true
+	})
+	return lease, lease.Expire > 0
+}
+
+// expiredAt - whether entry or its lease has expired as of logId and its committed time now, or entry is a deletion
+func expiredAt(txn local_store.Txn[string, string], entry Entry, logId paxos.LogId, now int64) bool {
+	if entry.Op == OP_DELETE || (entry.Expire > 0 && entry.Expire <= now) {
+		return true
+	}
+	if entry.Lease > 0 {
+		lease, ok := leaseAt(txn, entry.Lease, logId)
+		return !ok || lease.Expire <= now
+	}
+	return false
+}
+
+// parseRevisionKey - split rev/<ordered key><logId>
+func parseRevisionKey(k string) (string, paxos.LogId, bool) {
+	rest, ok := strings.CutPrefix(k, STATE_REVISION)
+	if !ok {
+		return "", 0, false
+	}
+	key, tail, err := codec.ReadOrdered([]byte(rest))
+	if err != nil {
+		panic(err)
+	}
+	n, err := strconv.ParseUint(string(tail), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return key, paxos.LogId(n), true
+}
+
+// parseLeaseRevisionKey - split revlease/<id>/<logId>, the id is kept as in k
+func parseLeaseRevisionKey(k string) (string, paxos.LogId, bool) {
+	rest, ok := strings.CutPrefix(k, STATE_LEASE_REVISION)
+	if !ok {
+		return "", 0, false
+	}
+	id, rev, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(rev, 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return id, paxos.LogId(n), true
+}
+
+func parseEntry(v string) Entry {
+	var entry Entry
+	err := json.Unmarshal([]byte(v), &entry)
+	if err != nil {
+		panic(err)
+	}
+	return entry
+}
+
+// scanRevisions - call f on every key with start <= key < end with its latest revision at or before logId in order
+// until f returns false, empty end means no upper bound
+// deleted keys are included with OP_DELETE
+func scanRevisions(txn local_store.Txn[string, string], start string, end string, logId paxos.LogId, f func(entry Entry) bool) {
+	var current Entry
+	found, stopped := false, false
+	txn.(local_store.OrderedTxn[string, string]).Scan(revisionPrefix(start), func(k string, v string) bool {
+		key, rev, ok := parseRevisionKey(k)
+		if !ok {
+			return false
+		}
+		if key != current.Key {
+			if len(end) > 0 && key >= end {
+				return false
+			}
+			if found && !f(current) {
+				stopped = true
+				return false
+			}
+			current, found = Entry{Key: key}, false
+		}
+		if rev <= logId {
+			current, found = parseEntry(v), true
+		}
+		return true
+	})
+	if found && !stopped {
+		f(current)
+	}
+}
+
+// Changes - changes of keys with prefix committed in [from, to) read from the revisions, to must have been applied
+// an event has the last change of every key written by its log entry in key order
+// ErrCompacted if some of those changes are no longer kept
+func (sm *stateMachine) Changes(prefix string, from paxos.LogId, to paxos.LogId) ([]WatchEvent, error) {
+	r := sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		// revisions at REVISION_FROM may be snapshots or have lost the deletions compacted into them
+		if revisionFrom, ok := getJSON[paxos.LogId](txn, STATE_REVISION_FROM); ok && from <= revisionFrom {
+			return ErrCompacted
+		}
+		changes := make(map[paxos.LogId][]Entry)
+		txn.(local_store.OrderedTxn[string, string]).Scan(STATE_REVISION+string(codec.AppendOrderedPrefix(nil, prefix)), func(k string, v string) bool {
+			key, rev, ok := parseRevisionKey(k)
+			if !ok || !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			if from <= rev && rev < to {
+				changes[rev] = append(changes[rev], parseEntry(v))
+			}
+			return true
+		})
+		events := make([]WatchEvent, 0, len(changes))
+		for logId, entries := range changes {
+			events = append(events, WatchEvent{
+				LogId:   logId,
+				Entries: entries,
+			})
+		}
+		slices.SortFunc(events, func(a WatchEvent, b WatchEvent) int {
+			return cmp.Compare(a.LogId, b.LogId)
+		})
+		return events
+	})
+	if err, ok := r.(error); ok {
+		return nil, err
+	}
+	return r.([]WatchEvent), nil
+}
+
+// compactedWithoutLock - whether revisions at logId are no longer kept
+func compactedWithoutLock(txn local_store.Txn[string, string], logId paxos.LogId) bool {
+	from, _ := getJSON[paxos.LogId](txn, STATE_REVISION_FROM)
+	return logId < from
+}
+
+// GetAt - entry of key as of logId, logId must have been applied
+func (sm *stateMachine) GetAt(key string, logId paxos.LogId) (Entry, error) {
+	r := sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		if compactedWithoutLock(txn, logId) {
+			return ErrCompacted
+		}
+		entry := Entry{
+			Key: key,
+			Val: nil,
+			Ver: 0,
+		}
+		txn.(local_store.OrderedTxn[string, string]).Scan(revisionPrefix(key), func(k string, v string) bool {
+			revKey, rev, ok := parseRevisionKey(k)
+			if !ok || revKey != key || rev > logId {
+				return false
+			}
+			entry = parseEntry(v)
+			return true
+		})
+		if expiredAt(txn, entry, logId, timeAt(txn, logId)) {
+			return Entry{
+				Key: key,
+				Val: nil,
+				Ver: 0,
+			}
+		}
+		return entry
+	})
+	if err, ok := r.(error); ok {
+		return Entry{}, err
+	}
+	return r.(Entry), nil
+}
+
+// ScanAt - Scan as of logId, logId must have been applied
+func (sm *stateMachine) ScanAt(start string, end string, limit int, logId paxos.LogId) ([]Entry, bool, error) {
+	r := sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		if compactedWithoutLock(txn, logId) {
+			return ErrCompacted
+		}
+		now := timeAt(txn, logId)
+		entries := make([]Entry, 0)
+		more := false
+		scanRevisions(txn, start, end, logId, func(entry Entry) bool {
+			if expiredAt(txn, entry, logId, now) {
+				return true
+			}
+			if len(entries) >= limit {
+				more = true
+				return false
+			}
+			entries = append(entries, entry)
+			return true
+		})
+		return [2]any{entries, more}
+	})
+	if err, ok := r.(error); ok {
+		return nil, false, err
+	}
+	return r.([2]any)[0].([]Entry), r.([2]any)[1].(bool), nil
+}
+
+// Compact - drop revisions that reads as of logId and later do not need
+// for every key and every lease only the latest revision at or before logId is kept, unless it is a deletion or a revocation
+func (sm *stateMachine) Compact(logId paxos.LogId) {
+	sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		from, _ := getJSON[paxos.LogId](txn, STATE_REVISION_FROM)
+		setJSON(txn, STATE_REVISION_FROM, max(from, logId))
+		return nil
+	})
+	for done := false; !done; {
+		// times up to logId are not needed by reads as of logId and later
+		done = sm.store.Update(func(txn local_store.Txn[string, string]) any {
+			drop := make([]string, 0)
+			txn.(local_store.OrderedTxn[string, string]).Scan(STATE_REVISION_TIME, func(k string, v string) bool {
+				if !strings.HasPrefix(k, STATE_REVISION_TIME) || k > revisionTimeKey(logId) || len(drop) >= PRUNE_BATCH_SIZE {
+					return false
+				}
+				drop = append(drop, k)
+				return true
+			})
+			for _, k := range drop {
+				txn.Del(k)
+			}
+			return len(drop) < PRUNE_BATCH_SIZE
+		}).(bool)
+	}
+	sm.pruneRevisions(STATE_REVISION, logId, parseRevisionKey, func(v string) bool {
+		return parseEntry(v).Op == OP_DELETE
+	})
+	sm.pruneRevisions(STATE_LEASE_REVISION, logId, parseLeaseRevisionKey, func(v string) bool {
+		var lease Lease
+		err := json.Unmarshal([]byte(v), &lease)
+		if err != nil {
+			panic(err)
+		}
+		return lease.Expire == 0
+	})
+}
+
+// pruneRevisions - drop revisions under prefix that reads as of logId and later do not need
+// parse splits a revision into its group, a key or a lease id, and its logId
+// for every group only the latest revision at or before logId is kept, unless deleted reports a deletion
+func (sm *stateMachine) pruneRevisions(prefix string, logId paxos.LogId, parse func(k string) (string, paxos.LogId, bool), deleted func(v string) bool) {
+	start, done := prefix, false
+	for !done {
+		done = sm.store.Update(func(txn local_store.Txn[string, string]) any {
+			drop := make([]string, 0)
+			group, groupKey, groupDeleted := make([]string, 0), "", false
+			flush := func() {
+				if len(group) > 0 && !groupDeleted {
+					group = group[:len(group)-1]
+				}
+				drop = append(drop, group...)
+				group = group[:0]
+			}
+			n, finished := 0, true
+			txn.(local_store.OrderedTxn[string, string]).Scan(start, func(k string, v string) bool {
+				key, rev, ok := parse(k)
+				if !ok {
+					return false
+				}
+				if n == 0 || key != groupKey {
+					flush()
+					if n >= PRUNE_BATCH_SIZE {
+						start, finished = k, false
+						return false
+					}
+					groupKey, groupDeleted = key, false
+				}
+				n++
+				if rev <= logId {
+					group = append(group, k)
+					groupDeleted = deleted(v)
+				}
+				return true
+			})
+			if finished {
+				flush()
+			}
+			for _, k := range drop {
+				txn.Del(k)
+			}
+			return finished
+		}).(bool)
+	}
+}
+
+func (ds *store) Revision(ctx context.Context, consistency Consistency) (paxos.LogId, error) {
+	if err := ds.read(ctx, consistency); err != nil {
+		return 0, err
+	}
+	return max(ds.memStore.Next(), 1) - 1, nil
+}
+
+func (ds *store) GetAt(ctx context.Context, key string, logId paxos.LogId) (Entry, error) {
+	if !ds.waitApplied(ctx, logId) {
+		return Entry{}, ctx.Err()
+	}
+	return ds.memStore.GetAt(key, logId)
+}
+
+func (ds *store) ScanAt(ctx context.Context, start string, end string, limit int, logId paxos.LogId) ([]Entry, bool, error) {
+	if !ds.waitApplied(ctx, logId) {
+		return nil, false, ctx.Err()
+	}
+	return ds.memStore.ScanAt(start, end, limit, logId)
+}
@@ -0,0 +1,103 @@
+package dist_store
+
+import (
+	"testing"
+
+	"dist_kvstore/pkg/local_store"
+	"dist_kvstore/pkg/paxos"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// newTestStateMachine - state machine in an in-memory badger
+func newTestStateMachine(t *testing.T) *stateMachine {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return newStateMachine(local_store.NewBadgerStringStore(db).Append("state"), nil)
+}
+
+// applyAt - apply entries at logId with the committed time proposed at now
+func applyAt(sm *stateMachine, logId paxos.LogId, now int64, entries ...Entry) Result {
+	cmd := makeCmd(entries)
+	cmd.Time = now
+	return sm.Apply(logId, cmd).results[cmd.Uuid]
+}
+
+func TestRevisionsOfKeysWithCommonPrefix(t *testing.T) {
+	sm := newTestStateMachine(t)
+	applyAt(sm, 0, 1000, Put("a", []byte("1")))
+	applyAt(sm, 1, 1000, Put("a\x00b", []byte("2")), Put("a\x00", []byte("3")))
+	applyAt(sm, 2, 1000, Delete("a"))
+
+	entry, err := sm.GetAt("a", 1)
+	if err != nil || string(entry.Val) != "1" {
+		t.Fatalf("a as of 1 is %q %v, want 1", entry.Val, err)
+	}
+	entry, err = sm.GetAt("a", 2)
+	if err != nil || entry.Ver != 0 {
+		t.Fatalf("a as of 2 is %q at version %d %v, want unset", entry.Val, entry.Ver, err)
+	}
+	entries, more, err := sm.ScanAt("", "", 10, 1)
+	if err != nil || more || len(entries) != 3 {
+		t.Fatalf("scan as of 1 returned %d entries %v %v, want 3", len(entries), more, err)
+	}
+	for i, key := range []string{"a", "a\x00", "a\x00b"} {
+		if entries[i].Key != key {
+			t.Fatalf("entry %d of the scan is %q, want %q", i, entries[i].Key, key)
+		}
+	}
+	entries, _, err = sm.ScanAt("a\x00", "a\x00b", 10, 2)
+	if err != nil || len(entries) != 1 || entries[0].Key != "a\x00" {
+		t.Fatalf("scan of [a\\x00, a\\x00b) as of 2 returned %v %v", entries, err)
+	}
+}
+
+func TestRevisionsOfExpiredLease(t *testing.T) {
+	sm := newTestStateMachine(t)
+	// one more lease than expire revokes at once, the last one outlives its expiry by a logId
+	grant := makeCmd(nil)
+	grant.Time = 1000
+	for i := 0; i <= EXPIRE_BATCH_SIZE; i++ {
+		grant.Grant = append(grant.Grant, Lease{
+			Id:     0,
+			TTL:    100,
+			Expire: 0,
+		})
+	}
+	leases := sm.Apply(0, grant).results[grant.Uuid].Leases
+	last := leases[len(leases)-1].Id
+	put := Put("k", []byte("v"))
+	put.Lease = last
+	if result := applyAt(sm, 1, 1000, put); !result.Applied {
+		t.Fatal("put with a lease not applied")
+	}
+	applyAt(sm, 2, 2000)
+	if entry, err := sm.GetAt("k", 1); err != nil || string(entry.Val) != "v" {
+		t.Fatalf("k as of 1 is %q %v, want v", entry.Val, err)
+	}
+	// k is only deleted at 3, its lease has expired as of 2
+	if entry, err := sm.GetAt("k", 2); err != nil || entry.Ver != 0 {
+		t.Fatalf("k as of 2 is %q %v, want unset", entry.Val, err)
+	}
+	if entries, _, err := sm.ScanAt("", "", 10, 2); err != nil || len(entries) != 0 {
+		t.Fatalf("scan as of 2 returned %v %v, want nothing", entries, err)
+	}
+	applyAt(sm, 3, 2000)
+	if entry := sm.Get("k"); entry.Ver != 0 {
+		t.Fatalf("k is %q once its lease is revoked", entry.Val)
+	}
+
+	sm.Compact(3)
+	if _, err := sm.GetAt("k", 2); err != ErrCompacted {
+		t.Fatalf("read as of 2 after compacting at 3 returned %v", err)
+	}
+	if entry, err := sm.GetAt("k", 3); err != nil || entry.Ver != 0 {
+		t.Fatalf("k as of 3 after compaction is %q %v, want unset", entry.Val, err)
+	}
+}
@@ -0,0 +1,109 @@
+package dist_store
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"dist_kvstore/pkg/codec"
+	"dist_kvstore/pkg/paxos"
+
+	"github.com/google/uuid"
+)
+
+// SCHEMA_LAYOUTS - codec.Layout of EncodedTypes at every codec.BINARY_SCHEMA
+// when TestSchemaLayout fails, bump codec.BINARY_SCHEMA and record the new layout and golden encoding,
+// the entries of earlier schemas stay as they are
+var SCHEMA_LAYOUTS = map[byte]uint64{
+	1: 0x55f148d1a52e459a,
+}
+
+// SCHEMA_GOLDEN - goldenPromise encoded by codec.VERSIONED at every codec.BINARY_SCHEMA
+var SCHEMA_GOLDEN = map[byte]string{
+	1: "fe0101050104010000000000000000000000000000000101030101610101030001010101620001000104010161010300" +
+		"ff0000090900090101620000010664656c657465090900090101630001020109696e6372656d656e7407fb0a0a010709" +
+		"010201070b03e80f018bcfe568000103010801090f018bcfe568000101020101780102310101000909000f018bcfe568" +
+		"0001020101010e6c6f63616c686f73743a33303031010200000000000000000000000000000002010401010201077772" +
+		"697474656e010201010000010107646967657374010201070b03e80f018bcfe568000f018bcfe56800010a0101020102" +
+		"010e6c6f63616c686f73743a333030320102000102000000000000000000000000000000030001020101790102310000" +
+		"09090009000009000000000104010203",
+}
+
+// goldenPromise - log entry that sets every field of the encoded types it holds
+func goldenPromise() paxos.Promise[Cmd] {
+	ver := uint64(3)
+	lease := Lease{Id: 7, TTL: 1000, Expire: 1700000000000}
+	cmd := Cmd{
+		Uuid:    uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+		Conds:   []Cond{{Key: "a", Ver: &ver, Absent: false, Val: []byte{}}, {Key: "b", Ver: nil, Absent: true, Val: nil}},
+		Entries: []Entry{Put("a", []byte{0, 0xff}), Delete("b"), {Key: "c", Val: nil, Ver: 2, Op: OP_INCREMENT, Delta: -5, TTL: 10, Lease: 7, Expire: 0}},
+		Grant:   []Lease{lease},
+		Revoke:  []LeaseId{8, 9},
+		Time:    1700000000000,
+		Snapshot: &Snapshot{
+			Entries: []Entry{{Key: "x", Val: []byte("1"), Ver: 1, Op: OP_PUT, Delta: 0, TTL: 0, Lease: 0, Expire: 1700000000000}},
+			Members: []Member{{Id: 1, Addr: "localhost:3001"}},
+			Applied: []AppliedCmd{{
+				Uuid:   uuid.MustParse("00000000-0000-0000-0000-000000000002"),
+				Result: Result{LogId: 4, Applied: true, Outcomes: []Outcome{OUTCOME_WRITTEN}, Versions: []uint64{1}, Entries: nil, Leases: nil, Reused: true},
+				Digest: []byte("digest"),
+			}},
+			Leases:  []Lease{lease},
+			Time:    1700000000000,
+			LeaseId: 10,
+		},
+		Membership: &MembershipChange{Add: []Member{{Id: 2, Addr: "localhost:3002"}}, Remove: []paxos.ProposerId{0}},
+		Batch:      []Cmd{makeCmd([]Entry{Put("y", []byte("1"))})},
+		Digest:     []byte{1, 2, 3},
+	}
+	cmd.Batch[0].Uuid = uuid.MustParse("00000000-0000-0000-0000-000000000003")
+	return paxos.Promise[Cmd]{
+		Proposal: 5,
+		Accepted: 4,
+		Value:    &cmd,
+	}
+}
+
+func TestSchemaLayout(t *testing.T) {
+	layout := codec.Layout(EncodedTypes()...)
+	recorded, ok := SCHEMA_LAYOUTS[codec.BINARY_SCHEMA]
+	if !ok {
+		t.Fatalf("layout %#x of schema %d is not recorded", layout, codec.BINARY_SCHEMA)
+	}
+	if layout != recorded {
+		t.Fatalf("layout of the encoded types is %#x, schema %d has %#x, bump codec.BINARY_SCHEMA", layout, codec.BINARY_SCHEMA, recorded)
+	}
+}
+
+func TestSchemaGolden(t *testing.T) {
+	want := goldenPromise()
+	b, err := codec.VERSIONED.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != SCHEMA_GOLDEN[codec.BINARY_SCHEMA] {
+		t.Fatalf("golden log entry of schema %d is encoded as %x", codec.BINARY_SCHEMA, b)
+	}
+	for schema, golden := range SCHEMA_GOLDEN {
+		b, err := hex.DecodeString(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := paxos.Promise[Cmd]{}
+		err = codec.VERSIONED.Unmarshal(b, &p)
+		if schema != codec.BINARY_SCHEMA {
+			// values of another schema are rejected rather than read into the wrong fields
+			if !errors.Is(err, codec.ErrSchema) {
+				t.Fatalf("golden log entry of schema %d decoded with %v", schema, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p, want) {
+			t.Fatalf("golden log entry of schema %d is decoded as %+v", schema, p)
+		}
+	}
+}
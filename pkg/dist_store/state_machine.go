@@ -1,6 +1,17 @@
 package dist_store
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
 	"dist_kvstore/pkg/local_store"
 
 	"dist_kvstore/pkg/paxos"
@@ -8,17 +19,351 @@ import (
 	"github.com/google/uuid"
 )
 
+// Op - operation of an entry of a command
+type Op string
+
+const (
+	OP_PUT           Op = ""              // write Val, it may be empty
+	OP_DELETE        Op = "delete"        // delete Key, a deleted entry is read as an entry with Ver 0
+	OP_INCREMENT     Op = "increment"     // add Delta to the decimal integer in the current value, an unset key is 0
+	OP_APPEND        Op = "append"        // append Val to the current value
+	OP_PUT_IF_ABSENT Op = "put_if_absent" // write Val if Key is not set, otherwise the command is not applied
+)
+
+// Entry - keys are strings of valid UTF-8, values are arbitrary bytes
+// in a command it is an operation on Key, the state machine assigns the next version if Ver is 0
 type Entry struct {
-	Key string `json:"key"`
-	Val string `json:"val"`
-	Ver uint64 `json:"ver"`
+	Key    string  `json:"key"`
+	Val    []byte  `json:"val"` // a string in JSON, or val_base64 if it is not valid UTF-8
+	Ver    uint64  `json:"ver"`
+	Op     Op      `json:"op,omitempty"`
+	Delta  int64   `json:"delta,omitempty"`  // OP_INCREMENT only
+	TTL    int64   `json:"ttl,omitempty"`    // milliseconds the entry lives after it is written, 0 means forever
+	Lease  LeaseId `json:"lease,omitempty"`  // the entry is deleted when the lease expires or is revoked
+	Expire int64   `json:"expire,omitempty"` // committed time in unix milliseconds the entry expires at, set by the state machine
+}
+
+// Cond - precondition on the current entry of Key, every field that is set must hold
+type Cond struct {
+	Key    string  `json:"key"`
+	Ver    *uint64 `json:"ver,omitempty"`    // current version equals Ver
+	Absent bool    `json:"absent,omitempty"` // key is not set
+	Val    []byte  `json:"val"`              // current value equals Val unless Val is nil, []byte{} is the empty value
+}
+
+// Put - write val to key
+func Put(key string, val []byte) Entry {
+	return Entry{
+		Key: key,
+		Val: val,
+		Op:  OP_PUT,
+	}
+}
+
+// Delete - delete key
+func Delete(key string) Entry {
+	return Entry{
+		Key: key,
+		Op:  OP_DELETE,
+	}
+}
+
+// Increment - add delta to the decimal integer at key
+func Increment(key string, delta int64) Entry {
+	return Entry{
+		Key:   key,
+		Op:    OP_INCREMENT,
+		Delta: delta,
+	}
+}
+
+// Append - append val to the value at key
+func Append(key string, val []byte) Entry {
+	return Entry{
+		Key: key,
+		Val: val,
+		Op:  OP_APPEND,
+	}
+}
+
+// PutIfAbsent - write val to key unless it is set
+func PutIfAbsent(key string, val []byte) Entry {
+	return Entry{
+		Key: key,
+		Val: val,
+		Op:  OP_PUT_IF_ABSENT,
+	}
+}
+
+// ErrValEncoding - a JSON value has both val and val_base64
+var ErrValEncoding = errors.New("val and val_base64 are exclusive")
+
+// jsonVal - val is the value as a string, values that are not valid UTF-8 are in val_base64 instead
+// a missing val and val_base64 is a nil value
+type jsonVal struct {
+	Val       *string `json:"val,omitempty"`
+	ValBase64 []byte  `json:"val_base64,omitempty"`
+}
+
+func makeJSONVal(val []byte) jsonVal {
+	if val != nil && !utf8.Valid(val) {
+		return jsonVal{
+			Val:       nil,
+			ValBase64: val,
+		}
+	}
+	s := string(val)
+	return jsonVal{
+		Val:       &s,
+		ValBase64: nil,
+	}
+}
+
+func (v jsonVal) val() ([]byte, error) {
+	switch {
+	case v.Val != nil && v.ValBase64 != nil:
+		return nil, ErrValEncoding
+	case v.ValBase64 != nil:
+		return v.ValBase64, nil
+	case v.Val != nil:
+		return []byte(*v.Val), nil
+	default:
+		return nil, nil
+	}
+}
+
+// entryJSON - fields of Entry after Val
+type entryJSON struct {
+	Ver    uint64  `json:"ver"`
+	Op     Op      `json:"op,omitempty"`
+	Delta  int64   `json:"delta,omitempty"`
+	TTL    int64   `json:"ttl,omitempty"`
+	Lease  LeaseId `json:"lease,omitempty"`
+	Expire int64   `json:"expire,omitempty"`
+}
+
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key string `json:"key"`
+		jsonVal
+		entryJSON
+	}{
+		Key:     e.Key,
+		jsonVal: makeJSONVal(e.Val),
+		entryJSON: entryJSON{
+			Ver:    e.Ver,
+			Op:     e.Op,
+			Delta:  e.Delta,
+			TTL:    e.TTL,
+			Lease:  e.Lease,
+			Expire: e.Expire,
+		},
+	})
+}
+
+func (e *Entry) UnmarshalJSON(b []byte) error {
+	v := struct {
+		Key string `json:"key"`
+		jsonVal
+		entryJSON
+	}{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	val, err := v.val()
+	if err != nil {
+		return err
+	}
+	*e = Entry{
+		Key:    v.Key,
+		Val:    val,
+		Ver:    v.Ver,
+		Op:     v.Op,
+		Delta:  v.Delta,
+		TTL:    v.TTL,
+		Lease:  v.Lease,
+		Expire: v.Expire,
+	}
+	return nil
+}
+
+// condJSON - fields of Cond after Val
+type condJSON struct {
+	Ver    *uint64 `json:"ver,omitempty"`
+	Absent bool    `json:"absent,omitempty"`
+}
+
+func (c Cond) MarshalJSON() ([]byte, error) {
+	v := makeJSONVal(c.Val)
+	if c.Val == nil {
+		v.Val = nil
+	}
+	return json.Marshal(struct {
+		Key string `json:"key"`
+		jsonVal
+		condJSON
+	}{
+		Key:     c.Key,
+		jsonVal: v,
+		condJSON: condJSON{
+			Ver:    c.Ver,
+			Absent: c.Absent,
+		},
+	})
+}
+
+func (c *Cond) UnmarshalJSON(b []byte) error {
+	v := struct {
+		Key string `json:"key"`
+		jsonVal
+		condJSON
+	}{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	val, err := v.val()
+	if err != nil {
+		return err
+	}
+	*c = Cond{
+		Key:    v.Key,
+		Ver:    v.Ver,
+		Absent: v.Absent,
+		Val:    val,
+	}
+	return nil
 }
 
+// resolve - entry written by op on the current entry, false if op cannot be applied to it
+func resolve(op Entry, current Entry, now int64) (Entry, Outcome, bool) {
+	entry := Entry{
+		Key:    op.Key,
+		Val:    op.Val,
+		Ver:    op.Ver,
+		Op:     OP_PUT,
+		TTL:    op.TTL,
+		Lease:  op.Lease,
+		Expire: 0,
+	}
+	if entry.TTL > 0 {
+		entry.Expire = now + entry.TTL
+	}
+	switch op.Op {
+	case OP_PUT:
+	case OP_DELETE:
+		entry = Entry{
+			Key: op.Key,
+			Val: nil,
+			Ver: op.Ver,
+			Op:  OP_DELETE,
+		}
+	case OP_INCREMENT:
+		n := int64(0)
+		if current.Ver > 0 {
+			var err error
+			n, err = strconv.ParseInt(string(current.Val), 10, 64)
+			if err != nil {
+				return Entry{}, OUTCOME_INVALID, false
+			}
+		}
+		sum := n + op.Delta
+		if (op.Delta > 0 && sum < n) || (op.Delta < 0 && sum > n) {
+			return Entry{}, OUTCOME_INVALID, false // overflows int64
+		}
+		entry.Val = strconv.AppendInt(nil, sum, 10)
+	case OP_APPEND:
+		entry.Val = append(slices.Clip(current.Val), op.Val...)
+	case OP_PUT_IF_ABSENT:
+		if current.Ver > 0 {
+			return Entry{}, OUTCOME_EXISTS, false
+		}
+	default:
+		return Entry{}, OUTCOME_INVALID, false
+	}
+	if (op.Op == OP_INCREMENT || op.Op == OP_APPEND) && op.TTL == 0 && op.Lease == 0 {
+		// keep the expiry and the lease of the current value
+		entry.TTL, entry.Lease, entry.Expire = current.TTL, current.Lease, current.Expire
+	}
+	if entry.Ver == 0 {
+		entry.Ver = current.Ver + 1
+	}
+	if entry.Ver <= current.Ver {
+		return Entry{}, OUTCOME_STALE, false
+	}
+	return entry, OUTCOME_WRITTEN, true
+}
+
+func (c Cond) holds(entry Entry) bool {
+	if c.Ver != nil && entry.Ver != *c.Ver {
+		return false
+	}
+	if c.Absent && entry.Ver != 0 {
+		return false
+	}
+	if c.Val != nil && (entry.Ver == 0 || !bytes.Equal(entry.Val, c.Val)) {
+		return false
+	}
+	return true
+}
+
+// Outcome - outcome of an entry of a command
+type Outcome string
+
+const (
+	OUTCOME_WRITTEN Outcome = "written"
+	OUTCOME_STALE   Outcome = "stale"   // version is not newer than the current one
+	OUTCOME_ABORTED Outcome = "aborted" // not written because a precondition failed or another entry is stale
+	OUTCOME_INVALID Outcome = "invalid" // the operation is unknown, the current value is not an integer to increment or the increment overflows
+	OUTCOME_EXISTS  Outcome = "exists"  // the key of OP_PUT_IF_ABSENT is set
+)
+
+// Result - committed outcome of a command
+type Result struct {
+	LogId    paxos.LogId `json:"log_id"`           // logId the command was committed at
+	Applied  bool        `json:"applied"`          // false if a precondition failed or an entry is not newer than the current one
+	Outcomes []Outcome   `json:"outcomes"`         // outcome of each entry of the command
+	Versions []uint64    `json:"versions"`         // version of each entry of the command once applied, 0 if deleted
+	Entries  []Entry     `json:"entries"`          // current entries of the keys the command reads or writes
+	Leases   []Lease     `json:"leases,omitempty"` // granted leases in the order of Cmd.Grant
+	Reused   bool        `json:"reused,omitempty"` // not applied, the uuid has been applied to a command with another digest
+}
+
+// Cmd - Entries are written atomically if every precondition in Conds holds
+// and every entry has a larger version than the current one, Ver 0 means the next version
+// leases in Grant and Revoke are changed in the same transaction, an entry may only attach to an existing lease
 type Cmd struct {
-	Uuid    uuid.UUID `json:"uuid"`
-	Entries []Entry   `json:"entries"`
+	Uuid       uuid.UUID         `json:"uuid"`
+	Conds      []Cond            `json:"conds,omitempty"`
+	Entries    []Entry           `json:"entries"`
+	Grant      []Lease           `json:"grant,omitempty"`  // grant new leases or keep existing ones alive
+	Revoke     []LeaseId         `json:"revoke,omitempty"` // revoke leases and delete their entries
+	Time       int64             `json:"time,omitempty"`   // unix milliseconds proposed by the leader, it drives expiry on every replica
+	Snapshot   *Snapshot         `json:"snapshot,omitempty"`
+	Membership *MembershipChange `json:"membership,omitempty"`
+	Batch      []Cmd             `json:"batch,omitempty"`  // commands of concurrent callers, applied in order
+	Digest     []byte            `json:"digest,omitempty"` // hash of the payload if Uuid is derived from an idempotency key
+}
+
+// Snapshot - compressed form of all commands up to some logId
+type Snapshot struct {
+	Entries []Entry      `json:"entries"`
+	Members []Member     `json:"members"`
+	Applied []AppliedCmd `json:"applied"` // dedup table from the oldest command
+	Leases  []Lease      `json:"leases"`
+	Time    int64        `json:"time"`       // committed time
+	LeaseId LeaseId      `json:"lease_next"` // id of the next granted lease
+}
+
+// AppliedCmd - result of an applied command kept to detect duplicates
+type AppliedCmd struct {
+	Uuid   uuid.UUID `json:"uuid"`
+	Result Result    `json:"result"`
+	Digest []byte    `json:"digest,omitempty"`
 }
 
+// DEDUP_SIZE - number of latest commands whose duplicates are detected
+const DEDUP_SIZE = 16384
+
 func makeCmd(entries []Entry) Cmd {
 	return Cmd{
 		Uuid:    uuid.New(),
@@ -26,45 +371,556 @@ func makeCmd(entries []Entry) Cmd {
 	}
 }
 
+// makeBatchCmd - coalesce commands into a single command
+func makeBatchCmd(cmds []Cmd) Cmd {
+	if len(cmds) == 1 {
+		return cmds[0]
+	}
+	cmd := makeCmd(nil)
+	cmd.Batch = cmds
+	return cmd
+}
+
 func (cmd Cmd) Equal(other Cmd) bool {
-	return cmd.Uuid == other.Uuid
+	return cmd.Uuid == other.Uuid && bytes.Equal(cmd.Digest, other.Digest)
+}
+
+// digest - hash of the payload of cmd, commands that write the same are of the same digest
+func (cmd Cmd) digest() []byte {
+	b, err := json.Marshal(Cmd{
+		Uuid:       uuid.Nil,
+		Conds:      cmd.Conds,
+		Entries:    cmd.Entries,
+		Grant:      cmd.Grant,
+		Revoke:     cmd.Revoke,
+		Time:       0,
+		Snapshot:   nil,
+		Membership: cmd.Membership,
+		Batch:      nil,
+		Digest:     nil,
+	})
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+const (
+	// keys of the state machine in its StringStore
+	STATE_ENTRY      = "kv/"      // entries by key
+	STATE_APPLIED    = "applied/" // results of remembered commands by uuid
+	STATE_DIGEST     = "digest/"  // digests of remembered commands with one by uuid
+	STATE_ORDER      = "order/"   // uuids of remembered commands by sequence number from the oldest
+	STATE_META       = "meta/"
+	STATE_NEXT       = "meta/next"       // smallest unapplied logId, 0 while a snapshot is being restored
+	STATE_MEMBERS    = "meta/members"    // acceptors that decide next
+	STATE_ORDER_HEAD = "meta/order_head" // sequence number of the oldest remembered command
+	STATE_ORDER_TAIL = "meta/order_tail" // sequence number of the next remembered command
+
+	// RESTORE_BATCH_BYTES - approximate size of a transaction while restoring a snapshot
+	RESTORE_BATCH_BYTES = 1 << 20
+)
+
+func getJSON[V any](txn local_store.Txn[string, string], key string) (V, bool) {
+	var v V
+	s, ok := txn.Get(key)
+	if !ok {
+		return v, false
+	}
+	err := json.Unmarshal([]byte(s), &v)
+	if err != nil {
+		panic(err)
+	}
+	return v, true
+}
+
+func setJSON(txn local_store.Txn[string, string], key string, v any) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	txn.Set(key, string(b))
+	return len(key) + len(b)
 }
 
+func orderKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", STATE_ORDER, seq)
+}
+
+// entryTxn - entries of the state machine as a Txn, every change is kept as a revision at logId
+type entryTxn struct {
+	txn   local_store.Txn[string, string]
+	logId paxos.LogId
+}
+
+func (t entryTxn) Get(key string) (Entry, bool) {
+	return getJSON[Entry](t.txn, STATE_ENTRY+key)
+}
+
+// Set - write an entry, its expiry, its attachment to a lease and its revision
+func (t entryTxn) Set(key string, entry Entry) {
+	t.unindex(key)
+	setJSON(t.txn, STATE_ENTRY+key, entry)
+	if entry.Expire > 0 {
+		t.txn.Set(expirePrefix(entry.Expire)+STATE_ENTRY+key, "")
+	}
+	if entry.Lease > 0 {
+		t.txn.Set(leaseKeysPrefix(entry.Lease)+key, "")
+	}
+	setJSON(t.txn, revisionKey(key, t.logId), entry)
+}
+
+func (t entryTxn) Del(key string) {
+	current, _ := t.Get(key)
+	t.delete(Entry{
+		Key: key,
+		Val: nil,
+		Ver: current.Ver + 1,
+		Op:  OP_DELETE,
+	})
+}
+
+// delete - delete the entry of deletion.Key and keep deletion as its revision
+// the revision is kept even if the key is unset so that it matches the change reported to watchers
+func (t entryTxn) delete(deletion Entry) {
+	if t.unindex(deletion.Key) {
+		t.txn.Del(STATE_ENTRY + deletion.Key)
+	}
+	setJSON(t.txn, revisionKey(deletion.Key, t.logId), deletion)
+}
+
+// unindex - remove the expiry and the lease attachment of the current entry, false if key is not set
+func (t entryTxn) unindex(key string) bool {
+	entry, ok := t.Get(key)
+	if !ok {
+		return false
+	}
+	if entry.Expire > 0 {
+		t.txn.Del(expirePrefix(entry.Expire) + STATE_ENTRY + key)
+	}
+	if entry.Lease > 0 {
+		t.txn.Del(leaseKeysPrefix(entry.Lease) + key)
+	}
+	return true
+}
+
+// stateMachine - state persisted in its own StringStore so that a restart resumes from the smallest unapplied logId
 type stateMachine struct {
-	store local_store.MemStore[string, Entry]
+	store   local_store.StringStore
+	mu      sync.Mutex  // serializes Apply and Snapshot
+	cacheMu sync.Mutex  // protects next and members
+	next    paxos.LogId // smallest unapplied logId, cache of STATE_NEXT
+	members []Member    // acceptors that decide next, cache of STATE_MEMBERS
 }
 
-func newStateMachine() *stateMachine {
-	return &stateMachine{
-		store: local_store.NewMemStore[string, Entry](),
+// newStateMachine - load the state from store, members is the bootstrap membership if nothing has been applied
+func newStateMachine(store local_store.StringStore, members []Member) *stateMachine {
+	sm := &stateMachine{
+		store:   store,
+		mu:      sync.Mutex{},
+		cacheMu: sync.Mutex{},
+		next:    0,
+		members: members,
 	}
+	store.Update(func(txn local_store.Txn[string, string]) any {
+		if next, ok := getJSON[paxos.LogId](txn, STATE_NEXT); ok {
+			sm.next = next
+		}
+		if members, ok := getJSON[[]Member](txn, STATE_MEMBERS); ok {
+			sm.members = members
+		}
+		return nil
+	})
+	return sm
+}
+
+// scan - call f on entries with key >= start in order until f returns false
+func scan(txn local_store.Txn[string, string], start string, f func(entry Entry) bool) {
+	txn.(local_store.OrderedTxn[string, string]).Scan(STATE_ENTRY+start, func(k string, v string) bool {
+		if !strings.HasPrefix(k, STATE_ENTRY) {
+			return false
+		}
+		var entry Entry
+		err := json.Unmarshal([]byte(v), &entry)
+		if err != nil {
+			panic(err)
+		}
+		return f(entry)
+	})
 }
 
 func (sm *stateMachine) Get(key string) Entry {
-	return sm.store.Update(func(txn local_store.Txn[string, Entry]) any {
-		return getDefaultEntry(txn, key)
+	return sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		now, _ := getJSON[int64](txn, STATE_TIME)
+		return getDefaultEntry(liveTxn{entryTxn{txn, 0}, now}, key)
 	}).(Entry)
 }
 
 func (sm *stateMachine) Keys() []string {
-	return sm.store.Update(func(txn local_store.Txn[string, Entry]) any {
-		return sm.store.Keys()
+	return sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		now, _ := getJSON[int64](txn, STATE_TIME)
+		keys := make([]string, 0)
+		scan(txn, "", func(entry Entry) bool {
+			if live(txn, entry, now) {
+				keys = append(keys, entry.Key)
+			}
+			return true
+		})
+		return keys
 	}).([]string)
 }
 
-func (sm *stateMachine) Apply(logId paxos.LogId, cmd Cmd) {
-	sm.store.Update(func(txn local_store.Txn[string, Entry]) any {
-		for _, entry := range cmd.Entries {
-			oldEntry := getDefaultEntry(txn, entry.Key)
-			if entry.Ver <= oldEntry.Ver {
-				continue // ignore update
+// Scan - get at most limit entries with start <= key < end in order, empty end means no upper bound
+// return whether more entries follow
+func (sm *stateMachine) Scan(start string, end string, limit int) ([]Entry, bool) {
+	r := sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		now, _ := getJSON[int64](txn, STATE_TIME)
+		entries := make([]Entry, 0)
+		more := false
+		scan(txn, start, func(entry Entry) bool {
+			if len(end) > 0 && entry.Key >= end {
+				return false
 			}
-			if len(entry.Val) == 0 {
-				txn.Del(entry.Key)
-			} else {
-				txn.Set(entry.Key, entry)
+			if !live(txn, entry, now) {
+				return true
+			}
+			if len(entries) >= limit {
+				more = true
+				return false
+			}
+			entries = append(entries, entry)
+			return true
+		})
+		return [2]any{entries, more}
+	}).([2]any)
+	return r[0].([]Entry), r[1].(bool)
+}
+
+// Membership - get the smallest unapplied logId and the acceptors that decide it
+func (sm *stateMachine) Membership() (paxos.LogId, []Member) {
+	sm.cacheMu.Lock()
+	defer sm.cacheMu.Unlock()
+	return sm.next, sm.members
+}
+
+// Snapshot - make a snapshot command of all applied commands
+func (sm *stateMachine) Snapshot() (paxos.LogId, Cmd, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	next, members := sm.Membership()
+	if next == 0 {
+		return 0, Cmd{}, false
+	}
+	r := sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		entries := make([]Entry, 0)
+		scan(txn, "", func(entry Entry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		head, _ := getJSON[uint64](txn, STATE_ORDER_HEAD)
+		tail, _ := getJSON[uint64](txn, STATE_ORDER_TAIL)
+		applied := make([]AppliedCmd, 0, tail-head)
+		for seq := head; seq < tail; seq++ {
+			id, _ := getJSON[uuid.UUID](txn, orderKey(seq))
+			result, _ := getJSON[Result](txn, STATE_APPLIED+id.String())
+			digest, _ := getJSON[[]byte](txn, STATE_DIGEST+id.String())
+			applied = append(applied, AppliedCmd{
+				Uuid:   id,
+				Result: result,
+				Digest: digest,
+			})
+		}
+		leases := make([]Lease, 0)
+		txn.(local_store.OrderedTxn[string, string]).Scan(STATE_LEASE, func(k string, v string) bool {
+			if !strings.HasPrefix(k, STATE_LEASE) {
+				return false
 			}
+			var lease Lease
+			err := json.Unmarshal([]byte(v), &lease)
+			if err != nil {
+				panic(err)
+			}
+			leases = append(leases, lease)
+			return true
+		})
+		now, _ := getJSON[int64](txn, STATE_TIME)
+		leaseId, _ := getJSON[LeaseId](txn, STATE_LEASE_NEXT)
+		return &Snapshot{
+			Entries: entries,
+			Members: members,
+			Applied: applied,
+			Leases:  leases,
+			Time:    now,
+			LeaseId: leaseId,
 		}
+	})
+	cmd := makeCmd(nil)
+	cmd.Snapshot = r.(*Snapshot)
+	return next - 1, cmd, true
+}
+
+// Next - smallest unapplied logId
+func (sm *stateMachine) Next() paxos.LogId {
+	next, _ := sm.Membership()
+	return next
+}
+
+// outcome - outcome of applying a log entry
+type outcome struct {
+	results  map[uuid.UUID]Result // results of the command and of every command in its batch
+	changes  []Entry              // written entries in order, a deleted entry has OP_DELETE
+	restored bool                 // the state has been restored from a snapshot
+}
+
+func (sm *stateMachine) Apply(logId paxos.LogId, cmd Cmd) outcome {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	_, members := sm.Membership()
+	if cmd.Snapshot != nil {
+		sm.restore(logId, cmd.Snapshot)
+		members = cmd.Snapshot.Members
+	}
+	r := sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		now := committedTime(txn, logId, cmd.Time)
+		o := outcome{
+			results:  make(map[uuid.UUID]Result),
+			changes:  expire(txn, logId, now),
+			restored: cmd.Snapshot != nil,
+		}
+		members := applyWithoutLock(txn, logId, now, cmd, members, &o)
+		setJSON(txn, STATE_NEXT, logId+1)
+		setJSON(txn, STATE_MEMBERS, members)
+		return [2]any{o, members}
+	}).([2]any)
+	sm.cacheMu.Lock()
+	sm.next, sm.members = logId+1, r[1].([]Member)
+	sm.cacheMu.Unlock()
+	return r[0].(outcome)
+}
+
+// restore - replace the state by snapshot in transactions of about RESTORE_BATCH_BYTES
+// STATE_NEXT is 0 until the snapshot command has been applied so that a restart restores it again
+// revisions before logId are lost
+func (sm *stateMachine) restore(logId paxos.LogId, snapshot *Snapshot) {
+	sm.store.Update(func(txn local_store.Txn[string, string]) any {
+		setJSON(txn, STATE_NEXT, paxos.LogId(0))
+		setJSON(txn, STATE_REVISION_FROM, logId)
+		setJSON(txn, STATE_ORDER_HEAD, uint64(0))
+		setJSON(txn, STATE_ORDER_TAIL, uint64(0))
+		setJSON(txn, STATE_TIME, snapshot.Time)
+		setJSON(txn, STATE_LEASE_NEXT, snapshot.LeaseId)
 		return nil
 	})
+	for {
+		deleted := sm.store.Update(func(txn local_store.Txn[string, string]) any {
+			keys := make([]string, 0)
+			size := 0
+			txn.(local_store.OrderedTxn[string, string]).Scan("", func(k string, v string) bool {
+				if strings.HasPrefix(k, STATE_META) {
+					return true
+				}
+				keys = append(keys, k)
+				size += len(k)
+				return size < RESTORE_BATCH_BYTES
+			})
+			for _, k := range keys {
+				txn.Del(k)
+			}
+			return len(keys)
+		}).(int)
+		if deleted == 0 {
+			break
+		}
+	}
+	for i := 0; i < len(snapshot.Entries); {
+		sm.store.Update(func(txn local_store.Txn[string, string]) any {
+			for size := 0; i < len(snapshot.Entries) && size < RESTORE_BATCH_BYTES; i++ {
+				entry := snapshot.Entries[i]
+				entryTxn{txn, logId}.Set(entry.Key, entry)
+				size += len(entry.Key) + len(entry.Val)
+			}
+			return nil
+		})
+	}
+	for i := 0; i < len(snapshot.Leases); {
+		sm.store.Update(func(txn local_store.Txn[string, string]) any {
+			for j := 0; i < len(snapshot.Leases) && j < RESTORE_BATCH_BYTES/64; i, j = i+1, j+1 {
+				setLease(txn, logId, snapshot.Leases[i])
+			}
+			return nil
+		})
+	}
+	for i := 0; i < len(snapshot.Applied); {
+		sm.store.Update(func(txn local_store.Txn[string, string]) any {
+			for size := 0; i < len(snapshot.Applied) && size < RESTORE_BATCH_BYTES; i++ {
+				size += remember(txn, snapshot.Applied[i].Uuid, snapshot.Applied[i].Result, snapshot.Applied[i].Digest)
+			}
+			return nil
+		})
+	}
+}
+
+// applyWithoutLock - apply cmd and the commands in its batch, return the acceptors that decide the next logId
+func applyWithoutLock(txn local_store.Txn[string, string], logId paxos.LogId, now int64, cmd Cmd, members []Member, o *outcome) []Member {
+	if result, ok := getJSON[Result](txn, STATE_APPLIED+cmd.Uuid.String()); ok {
+		o.results[cmd.Uuid] = result // duplicate, it has been applied at result.LogId
+		if digest, _ := getJSON[[]byte](txn, STATE_DIGEST+cmd.Uuid.String()); !bytes.Equal(digest, cmd.Digest) {
+			// the uuid has been reused for another payload, nothing is written
+			o.results[cmd.Uuid] = Result{
+				LogId:    logId,
+				Applied:  false,
+				Outcomes: slices.Repeat([]Outcome{OUTCOME_ABORTED}, len(cmd.Entries)),
+				Versions: nil,
+				Entries:  []Entry{},
+				Leases:   nil,
+				Reused:   true,
+			}
+		}
+		return members
+	}
+	valid := true // an invalid membership change is committed but not applied
+	if cmd.Membership != nil {
+		changed, err := cmd.Membership.apply(members)
+		if err == nil {
+			members = changed
+		}
+		valid = err == nil
+	}
+	result, changes := Result{
+		LogId:    logId,
+		Applied:  false,
+		Outcomes: slices.Repeat([]Outcome{OUTCOME_ABORTED}, len(cmd.Entries)),
+		Versions: nil,
+		Entries:  []Entry{},
+		Leases:   nil,
+		Reused:   false,
+	}, []Entry(nil)
+	if valid {
+		result, changes = applyTxnWithoutLock(txn, logId, now, cmd)
+	}
+	o.results[cmd.Uuid] = result
+	o.changes = append(o.changes, changes...)
+	if cmd.Membership != nil || len(cmd.Conds) > 0 || len(cmd.Entries) > 0 || len(cmd.Grant) > 0 || len(cmd.Revoke) > 0 {
+		remember(txn, cmd.Uuid, result, cmd.Digest)
+	}
+	for _, c := range cmd.Batch {
+		members = applyWithoutLock(txn, logId, now, c, members, o)
+	}
+	return members
+}
+
+// remember - keep the result of an applied command, evict the oldest beyond DEDUP_SIZE
+// return the approximate number of bytes written
+func remember(txn local_store.Txn[string, string], id uuid.UUID, result Result, digest []byte) int {
+	head, _ := getJSON[uint64](txn, STATE_ORDER_HEAD)
+	tail, _ := getJSON[uint64](txn, STATE_ORDER_TAIL)
+	size := setJSON(txn, STATE_APPLIED+id.String(), result)
+	if len(digest) > 0 {
+		size += setJSON(txn, STATE_DIGEST+id.String(), digest)
+	}
+	size += setJSON(txn, orderKey(tail), id)
+	tail++
+	if tail-head > DEDUP_SIZE {
+		oldest, _ := getJSON[uuid.UUID](txn, orderKey(head))
+		txn.Del(STATE_APPLIED + oldest.String())
+		txn.Del(STATE_DIGEST + oldest.String())
+		txn.Del(orderKey(head))
+		head++
+	}
+	size += setJSON(txn, STATE_ORDER_HEAD, head)
+	size += setJSON(txn, STATE_ORDER_TAIL, tail)
+	return size
+}
+
+// applyTxnWithoutLock - write cmd.Entries and change leases if every precondition holds, return the written and deleted entries
+func applyTxnWithoutLock(txn local_store.Txn[string, string], logId paxos.LogId, now int64, cmd Cmd) (Result, []Entry) {
+	et := entryTxn{txn, logId}
+	lt := liveTxn{et, now} // entries that expire are unset even if expire has not deleted them yet
+	keys := make([]string, 0, len(cmd.Conds)+len(cmd.Entries))
+	current := make(map[string]Entry)
+	get := func(key string) Entry {
+		if entry, ok := current[key]; ok {
+			return entry
+		}
+		keys = append(keys, key)
+		current[key] = getDefaultEntry(lt, key)
+		return current[key]
+	}
+	leased := func(id LeaseId) bool {
+		lease, ok := getJSON[Lease](txn, leaseKey(id))
+		return ok && lease.Expire > now
+	}
+	applied := true
+	for _, c := range cmd.Conds {
+		if !c.holds(get(c.Key)) {
+			applied = false
+		}
+	}
+	for _, lease := range cmd.Grant {
+		if lease.Id > 0 && !leased(lease.Id) {
+			applied = false // the lease to keep alive has expired
+		}
+	}
+	writes := make([]Entry, 0, len(cmd.Entries))
+	outcomes := make([]Outcome, 0, len(cmd.Entries))
+	versions := make([]uint64, 0, len(cmd.Entries))
+	for _, op := range cmd.Entries {
+		entry, outcome, ok := resolve(op, get(op.Key), now)
+		outcomes = append(outcomes, OUTCOME_ABORTED)
+		if !ok {
+			applied = false
+			outcomes[len(outcomes)-1] = outcome
+			continue
+		}
+		if entry.Op == OP_PUT && entry.Lease > 0 && !leased(entry.Lease) {
+			applied = false
+		}
+		// later entries of the same key apply to this one
+		current[entry.Key] = entry
+		versions = append(versions, entry.Ver)
+		if entry.Op == OP_DELETE {
+			current[entry.Key] = Entry{
+				Key: entry.Key,
+				Ver: 0,
+			}
+			versions[len(versions)-1] = 0
+		}
+		writes = append(writes, entry)
+	}
+	leases := make([]Lease, 0, len(cmd.Grant))
+	if applied {
+		for i := range outcomes {
+			outcomes[i] = OUTCOME_WRITTEN
+		}
+		for _, lease := range cmd.Grant {
+			lease, _ = grantLease(txn, logId, lease, now)
+			leases = append(leases, lease)
+		}
+		for _, entry := range writes {
+			if entry.Op == OP_DELETE {
+				et.delete(entry)
+			} else {
+				et.Set(entry.Key, entry)
+			}
+		}
+		for _, id := range cmd.Revoke {
+			writes = append(writes, revokeLease(txn, logId, id)...)
+		}
+	} else {
+		writes, leases, versions = nil, nil, nil
+	}
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, getDefaultEntry(lt, key))
+	}
+	return Result{
+		LogId:    logId,
+		Applied:  applied,
+		Outcomes: outcomes,
+		Versions: versions,
+		Entries:  entries,
+		Leases:   leases,
+		Reused:   false,
+	}, writes
 }
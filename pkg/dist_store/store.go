@@ -1,35 +1,106 @@
 package dist_store
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
 	"math/rand"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"dist_kvstore/pkg/codec"
 	"dist_kvstore/pkg/local_store"
 	"dist_kvstore/pkg/paxos"
 	"dist_kvstore/pkg/rpc"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
 )
 
 const (
 	BACKOFF_MIN_TIME = 10 * time.Millisecond
 	BACKOFF_MAX_TIME = 1000 * time.Millisecond
 	UPDATE_INTERVAL  = 100 * time.Millisecond
+	COMPACT_INTERVAL = 10 * time.Second
+	// COMPACT_THRESHOLD - minimal number of log entries to compact
+	COMPACT_THRESHOLD = 1024
+	// ELECTION_TIMEOUT - campaign if the leader has not renewed its promise for this long
+	ELECTION_TIMEOUT_MIN = 1000 * time.Millisecond
+	ELECTION_TIMEOUT_MAX = 2000 * time.Millisecond
+	// ROUND_TIMEOUT - deadline of a round of requests to the acceptors, peers that have not responded by then are unreachable
+	ROUND_TIMEOUT = 1000 * time.Millisecond
+
+	// prefixes of the log and the acceptor metadata, encoded by codec.VERSIONED
+	// the baseline kept the log in JSON under LEGACY_LOG_PREFIX, and no acceptor metadata
+	LOG_PREFIX        = "log_bin"
+	ACCEPTOR_PREFIX   = "acceptor_bin"
+	LEGACY_LOG_PREFIX = "log"
 )
 
 type DistStore interface {
 	Close() error
 	ListenAndServeRPC() error
-	Get(key string) Entry
-	Set(Cmd)
-	Keys() []string
+	// Get - entry of key, an error wrapping ErrNoQuorum or ctx.Err() if consistency cannot be met before ctx is done
+	Get(ctx context.Context, key string, consistency Consistency) (Entry, error)
+	Set(ctx context.Context, cmd Cmd) (Result, error)
+	Keys(ctx context.Context, consistency Consistency) ([]string, error)
+	// Watch - stream changes of keys with prefix committed from fromLogId in order
+	// the channel is closed when ctx is done or the watcher falls too far behind, resume from the last LogId received + 1
+	Watch(ctx context.Context, prefix string, fromLogId paxos.LogId) (<-chan WatchEvent, error)
+	// Next - smallest logId not applied to the local state machine
+	Next() paxos.LogId
+	// Scan - get at most limit entries with start <= key < end in order, empty end means no upper bound
+	// return whether more entries follow
+	Scan(ctx context.Context, start string, end string, limit int, consistency Consistency) ([]Entry, bool, error)
+	// Revision - logId of the state a read with consistency observes, read as of it with GetAt and ScanAt
+	// to get a consistent view of several keys
+	Revision(ctx context.Context, consistency Consistency) (paxos.LogId, error)
+	// GetAt - entry of key as of logId, wait until logId has been applied
+	// ErrCompacted if the revisions at logId are no longer kept
+	GetAt(ctx context.Context, key string, logId paxos.LogId) (Entry, error)
+	// ScanAt - Scan as of logId, wait until logId has been applied
+	// ErrCompacted if the revisions at logId are no longer kept
+	ScanAt(ctx context.Context, start string, end string, limit int, logId paxos.LogId) ([]Entry, bool, error)
+	Members() []Member
+	ChangeMembership(ctx context.Context, change MembershipChange) error
 }
 
-func makeHandlerFunc[Req any, Res any](acceptor paxos.Acceptor[Cmd]) func(*Req) *Res {
+// ErrNoQuorum - a quorum of acceptors is unreachable
+var ErrNoQuorum = errors.New("no quorum")
+
+// ErrIdempotencyKeyReused - the uuid of a command has been applied to a command with another payload
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused for another payload")
+
+// ErrInvalidKey - keys must be valid UTF-8
+var ErrInvalidKey = errors.New("key is not valid UTF-8")
+
+// validKeys - whether every key cmd reads or writes is valid UTF-8
+func validKeys(cmd Cmd) bool {
+	for _, c := range cmd.Conds {
+		if !utf8.ValidString(c.Key) {
+			return false
+		}
+	}
+	for _, entry := range cmd.Entries {
+		if !utf8.ValidString(entry.Key) {
+			return false
+		}
+	}
+	for _, c := range cmd.Batch {
+		if !validKeys(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func makeHandlerFunc[Req any, Res any](handle func(paxos.Request) paxos.Response) func(*Req) *Res {
 	return func(req *Req) *Res {
-		res := acceptor.HandleRPC(req)
+		res := handle(req)
 		if res == nil {
 			return nil
 		}
@@ -38,17 +109,90 @@ func makeHandlerFunc[Req any, Res any](acceptor paxos.Acceptor[Cmd]) func(*Req)
 }
 
 type store struct {
-	id           paxos.ProposerId
-	peerAddrList []string
-	db           *badger.DB
-	memStore     *stateMachine
-	acceptor     paxos.Acceptor[Cmd]
-	dispatcher   rpc.Dispatcher
-	server       rpc.TCPServer
-	rpcList      []paxos.RPC
-	writeMu      sync.Mutex
-	updateCtx    context.Context
-	updateCancel context.CancelFunc
+	id             paxos.ProposerId
+	peerAddrList   []string
+	db             *badger.DB
+	memStore       *stateMachine
+	acceptor       paxos.Acceptor[Cmd]
+	dispatcher     rpc.Dispatcher
+	server         rpc.TCPServer
+	transport      func(member Member) rpc.TransportFunc
+	revisionWindow paxos.LogId // number of logIds before the compacted log whose revisions are kept
+	closeMu        sync.RWMutex
+	closed         bool // the local acceptor must not be used once db is closed
+	updateCtx      context.Context
+	updateCancel   context.CancelFunc
+	updateWg       sync.WaitGroup
+
+	leaderMu        sync.Mutex
+	leader          *paxos.Leader[Cmd] // nil if this node is not the leader
+	leaderMembers   []Member           // acceptors that elected the leader
+	electionTimeout time.Duration
+
+	queue     chan *pending
+	inflight  chan struct{}      // one token for each logId in flight
+	nextLogId paxos.LogId        // next logId to write, owned by proposeLoop
+	recovered *paxos.Leader[Cmd] // leader that has written values accepted under previous proposals, protected by leaderMu
+	appliedMu sync.Mutex
+	applied   chan struct{}         // closed every time a log entry is applied
+	results   map[uuid.UUID]*Result // results of commands proposed on this node, nil until applied
+	ticking   atomic.Bool           // the leader is writing a command to expire entries and leases
+	writing   atomic.Uint64         // every logId the leader has started to write is below it, the read index it serves
+
+	caughtUpMu sync.Mutex
+	caughtUp   time.Time // every write committed before this time has been applied
+
+	watchMu     sync.Mutex
+	history     []WatchEvent // changes of the latest log entries
+	historyFrom paxos.LogId  // history has every change from this logId
+	watchers    map[*watcher]struct{}
+}
+
+// setRequest - Set forwarded to the leader
+type setRequest struct {
+	Cmd Cmd `json:"cmd"`
+}
+
+type setResponse struct {
+	Result Result `json:"result"`
+	Ok     bool   `json:"ok"`
+}
+
+// readIndexRequest - ask the leader for the index a linearizable read waits for
+type readIndexRequest struct {
+}
+
+type readIndexResponse struct {
+	LogId paxos.LogId `json:"log_id"`
+	Ok    bool        `json:"ok"`
+}
+
+// EncodedTypes - a value of every type encoded by the binary codec on the wire or in the data directory
+// codec.Layout of them changes whenever codec.BINARY_SCHEMA must be bumped
+func EncodedTypes() []any {
+	return []any{
+		paxos.LogId(0),
+		paxos.Proposal(0),
+		paxos.Promise[Cmd]{},
+		paxos.PrepareRequest{},
+		paxos.PrepareResponse[Cmd]{},
+		paxos.AcceptRequest[Cmd]{},
+		paxos.AcceptResponse[Cmd]{},
+		paxos.CommitRequest[Cmd]{},
+		paxos.CommitResponse{},
+		paxos.PollRequest{},
+		paxos.PollResponse[Cmd]{},
+		paxos.SyncRequest{},
+		paxos.SyncResponse[Cmd]{},
+		paxos.NextRequest{},
+		paxos.NextResponse{},
+		paxos.LeadRequest{},
+		paxos.LeadResponse[Cmd]{},
+		setRequest{},
+		setResponse{},
+		readIndexRequest{},
+		readIndexResponse{},
+	}
 }
 
 func getDefaultEntry(txn local_store.Txn[string, Entry], key string) Entry {
@@ -56,100 +200,196 @@ func getDefaultEntry(txn local_store.Txn[string, Entry], key string) Entry {
 	if !ok {
 		return Entry{
 			Key: key,
-			Val: "",
+			Val: nil,
 			Ver: 0,
 		}
 	}
 	return entry
 }
 
-func NewStore(id int, badgerPath string, peerAddrList []string) (DistStore, error) {
+// migrateCodec - move the log of a data directory written by the baseline, in JSON with string values, to codec.VERSIONED
+// the metadata values are LogId or Proposal, both are encoded as uint64
+func migrateCodec(ss local_store.StringStore) {
+	last := paxos.LogId(0) // largest logId of the converted log
+	local_store.MigrateStoreFunc(
+		ss.Append(LEGACY_LOG_PREFIX), codec.JSON,
+		ss.Append(LOG_PREFIX), codec.VERSIONED,
+		func(logId paxos.LogId, p paxos.Promise[legacyCmd]) paxos.Promise[Cmd] {
+			last = max(last, logId)
+			return legacyPromise(p)
+		},
+	)
+	// the baseline kept no largest accepted logId
+	local_store.MakeStoreFromStringStore[string, paxos.LogId](ss.Append(ACCEPTOR_PREFIX), codec.VERSIONED).
+		Update(func(txn local_store.Txn[string, paxos.LogId]) any {
+			if v, _ := txn.Get(paxos.META_LAST); v < last {
+				txn.Set(paxos.META_LAST, last)
+			}
+			return nil
+		})
+}
+
+// NewStore - acceptor id of peerAddrList, acceptor i is at peerAddrList[i]
+// revisions are kept for revisionWindow logIds before the compacted log, REVISION_WINDOW if it is 0
+// acceptors in joining are left out of the bootstrap membership, they only vote once a change that adds them is committed
+func NewStore(id int, badgerPath string, peerAddrList []string, revisionWindow paxos.LogId, joining ...int) (DistStore, error) {
 	bindAddr := peerAddrList[id]
 	db, err := badger.Open(badger.DefaultOptions(badgerPath))
 	if err != nil {
 		return nil, err
 	}
-	ss := local_store.NewBadgerStringStore(db).Append("log")
-	acceptor := paxos.NewAcceptor(local_store.MakeStoreFromStringStore[paxos.LogId, paxos.Promise[Cmd]](ss))
-	memStore := newStateMachine()
-	acceptor.Subscribe(0, memStore.Apply)
-
-	dispatcher := rpc.NewDispatcher().
-		Register("prepare", makeHandlerFunc[paxos.PrepareRequest, paxos.PrepareResponse[Cmd]](acceptor)).
-		Register("accept", makeHandlerFunc[paxos.AcceptRequest[Cmd], paxos.AcceptResponse[Cmd]](acceptor)).
-		Register("commit", makeHandlerFunc[paxos.CommitRequest[Cmd], paxos.CommitResponse](acceptor)).
-		Register("poll", makeHandlerFunc[paxos.PollRequest, paxos.PollResponse[Cmd]](acceptor))
+	ss := local_store.NewBadgerStringStore(db)
+	migrateCodec(ss)
+	acceptor := paxos.NewAcceptor(
+		local_store.MakeStoreFromStringStore[paxos.LogId, paxos.Promise[Cmd]](ss.Append(LOG_PREFIX), codec.VERSIONED),
+		ss.Append(ACCEPTOR_PREFIX),
+		codec.VERSIONED,
+	)
+	// bootstrap membership, it is replaced by the membership in the log once that is applied
+	members := make([]Member, 0, len(peerAddrList))
+	for i, addr := range peerAddrList {
+		if slices.Contains(joining, i) {
+			continue
+		}
+		members = append(members, Member{
+			Id:   paxos.ProposerId(i),
+			Addr: addr,
+		})
+	}
+	memStore := newStateMachine(ss.Append("state"), members)
 
-	server, err := rpc.NewTCPServer(bindAddr)
+	server, transport, err := newServer(bindAddr, memStore)
 	if err != nil {
 		return nil, err
 	}
 
-	rpcList := make([]paxos.RPC, len(peerAddrList))
-	for i := range peerAddrList {
-		i := i
-		if i == id {
-			rpcList[i] = func(req paxos.Request, resCh chan<- paxos.Response) {
-				resCh <- acceptor.HandleRPC(req)
-			}
-		} else {
-			rpcList[i] = func(req paxos.Request, resCh chan<- paxos.Response) {
-				transport := rpc.TCPTransport(peerAddrList[i])
-				res, err := func() (paxos.Response, error) {
-					switch req := req.(type) {
-					case *paxos.PrepareRequest:
-						return rpc.RPC[paxos.PrepareRequest, paxos.PrepareResponse[Cmd]](transport, "prepare", req)
-					case *paxos.AcceptRequest[Cmd]:
-						return rpc.RPC[paxos.AcceptRequest[Cmd], paxos.AcceptResponse[Cmd]](transport, "accept", req)
-					case *paxos.CommitRequest[Cmd]:
-						return rpc.RPC[paxos.CommitRequest[Cmd], paxos.CommitResponse](transport, "commit", req)
-					case *paxos.PollRequest:
-						return rpc.RPC[paxos.PollRequest, paxos.PollResponse[Cmd]](transport, "poll", req)
-					default:
-						return nil, nil
-					}
-				}()
-				if err != nil {
-					res = nil
-				}
-				resCh <- res
-			}
+	updateCtx, updateCancel := context.WithCancel(context.Background())
+	ds := &store{
+		id:             paxos.ProposerId(id),
+		peerAddrList:   peerAddrList,
+		db:             db,
+		memStore:       memStore,
+		acceptor:       acceptor,
+		dispatcher:     rpc.NewDispatcher(),
+		server:         server,
+		transport:      transport,
+		revisionWindow: cmp.Or(revisionWindow, REVISION_WINDOW),
+		closeMu:        sync.RWMutex{},
+		closed:         false,
+		updateCtx:      updateCtx,
+		updateCancel:   updateCancel,
+		updateWg:       sync.WaitGroup{},
+
+		leaderMu:        sync.Mutex{},
+		leader:          nil,
+		leaderMembers:   nil,
+		electionTimeout: randomElectionTimeout(),
+
+		queue:     make(chan *pending, MAX_BATCH_SIZE),
+		inflight:  make(chan struct{}, MAX_INFLIGHT),
+		nextLogId: 0,
+		recovered: nil,
+		appliedMu: sync.Mutex{},
+		applied:   make(chan struct{}),
+		results:   make(map[uuid.UUID]*Result),
+		ticking:   atomic.Bool{},
+		writing:   atomic.Uint64{},
+
+		caughtUpMu: sync.Mutex{},
+		caughtUp:   time.Time{},
+
+		watchMu:     sync.Mutex{},
+		history:     nil,
+		historyFrom: memStore.Next(),
+		watchers:    make(map[*watcher]struct{}),
+	}
+	acceptor.Subscribe(memStore.Next(), ds.apply)
+	ds.dispatcher.
+		Register("prepare", makeHandlerFunc[paxos.PrepareRequest, paxos.PrepareResponse[Cmd]](ds.handleRPC)).
+		Register("accept", makeHandlerFunc[paxos.AcceptRequest[Cmd], paxos.AcceptResponse[Cmd]](ds.handleRPC)).
+		Register("commit", makeHandlerFunc[paxos.CommitRequest[Cmd], paxos.CommitResponse](ds.handleRPC)).
+		Register("poll", makeHandlerFunc[paxos.PollRequest, paxos.PollResponse[Cmd]](ds.handleRPC)).
+		Register("sync", makeHandlerFunc[paxos.SyncRequest, paxos.SyncResponse[Cmd]](ds.handleRPC)).
+		Register("next", makeHandlerFunc[paxos.NextRequest, paxos.NextResponse](ds.handleRPC)).
+		Register("lead", makeHandlerFunc[paxos.LeadRequest, paxos.LeadResponse[Cmd]](ds.handleRPC)).
+		Register("set", ds.handleSet).
+		Register("read_index", ds.handleReadIndex)
+	return ds, nil
+}
+
+// newBackoff - sleep for a random exponentially growing duration on every call, return false if ctx is done
+func newBackoff(ctx context.Context) func() bool {
+	wait := BACKOFF_MIN_TIME
+	return func() bool {
+		timer := time.NewTimer(time.Duration(rand.Intn(int(wait))))
+		defer timer.Stop()
+		wait *= 2
+		if wait > BACKOFF_MAX_TIME {
+			wait = BACKOFF_MAX_TIME
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
 		}
 	}
+}
 
-	updateCtx, updateCancel := context.WithCancel(context.Background())
-	return &store{
-		id:           paxos.ProposerId(id),
-		peerAddrList: peerAddrList,
-		db:           db,
-		memStore:     memStore,
-		acceptor:     acceptor,
-		dispatcher:   dispatcher,
-		server:       server,
-		rpcList:      rpcList,
-		writeMu:      sync.Mutex{},
-		updateCtx:    updateCtx,
-		updateCancel: updateCancel,
-	}, nil
+func randomElectionTimeout() time.Duration {
+	return ELECTION_TIMEOUT_MIN + time.Duration(rand.Int63n(int64(ELECTION_TIMEOUT_MAX-ELECTION_TIMEOUT_MIN)))
 }
 
 func (ds *store) Close() error {
 	ds.updateCancel()
-	err1 := ds.db.Close()
-	err2 := ds.server.Close()
+	ds.updateWg.Wait() // the update loop must not touch db after it is closed
+	err1 := ds.server.Close()
+	ds.closeMu.Lock()
+	ds.closed = true
+	ds.closeMu.Unlock()
+	err2 := ds.db.Close()
 	return combineErrors(err1, err2)
 }
 
+// handleRPC - handle request with the local acceptor, requests still in flight after Close are dropped
+func (ds *store) handleRPC(req paxos.Request) paxos.Response {
+	ds.closeMu.RLock()
+	defer ds.closeMu.RUnlock()
+	if ds.closed {
+		return nil
+	}
+	return ds.acceptor.HandleRPC(req)
+}
+
 func (ds *store) ListenAndServeRPC() error {
+	ds.updateWg.Add(2)
 	go func() {
+		defer ds.updateWg.Done()
+		ds.proposeLoop()
+	}()
+	go func() {
+		defer ds.updateWg.Done()
 		ticker := time.NewTicker(UPDATE_INTERVAL)
 		defer ticker.Stop()
+		compactTicker := time.NewTicker(COMPACT_INTERVAL)
+		defer compactTicker.Stop()
 		for {
 			select {
 			case <-ds.updateCtx.Done():
 				return
 			case <-ticker.C:
-				paxos.Update(ds.acceptor, ds.rpcList)
+				next := ds.acceptor.Next()
+				_, _, rpcList := ds.membership()
+				// a snapshot transfer may take longer than a tick
+				if err := paxos.Update(ds.updateCtx, ds.acceptor, rpcList); err != nil {
+					fmt.Println(fmt.Errorf("node %d: %w", ds.id, err))
+				}
+				if ds.acceptor.Next() == next {
+					// only campaign once caught up with peers
+					ds.lead()
+				}
+			case <-compactTicker.C:
+				ds.compact()
 			}
 		}
 
@@ -157,31 +397,221 @@ func (ds *store) ListenAndServeRPC() error {
 	return ds.server.ListenAndServe(ds.dispatcher)
 }
 
-func (ds *store) Set(cmd Cmd) {
-	ds.writeMu.Lock()
-	defer ds.writeMu.Unlock()
-	wait := BACKOFF_MIN_TIME
-	backoff := func() {
-		time.Sleep(time.Duration(rand.Intn(int(wait))))
-		wait *= 2
-		if wait > BACKOFF_MAX_TIME {
-			wait = BACKOFF_MAX_TIME
+// roundCtx - context of a round of requests to the acceptors, cancelled once the store is closed
+func (ds *store) roundCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ds.updateCtx, ROUND_TIMEOUT)
+}
+
+// compact - compact the log into a snapshot of the state machine
+func (ds *store) compact() {
+	logId, cmd, ok := ds.memStore.Snapshot()
+	if !ok || logId < ds.acceptor.First()+COMPACT_THRESHOLD {
+		return
+	}
+	_, _, rpcList := ds.membership()
+	ctx, cancel := ds.roundCtx()
+	defer cancel()
+	if !paxos.LogCompact(ctx, ds.acceptor, logId, cmd, rpcList) {
+		return
+	}
+	// revisions are kept for a window before the compacted log
+	if logId > ds.revisionWindow {
+		ds.memStore.Compact(logId - ds.revisionWindow)
+	}
+}
+
+// getLeader - get the leader for members, the leader is elected again if membership has changed
+func (ds *store) getLeader(members []Member) *paxos.Leader[Cmd] {
+	ds.leaderMu.Lock()
+	defer ds.leaderMu.Unlock()
+	if ds.leader == nil || slices.Equal(ds.leaderMembers, members) {
+		return ds.leader
+	}
+	ds.leader, ds.leaderMembers = nil, nil
+	if !containsMember(members, ds.id) {
+		return nil
+	}
+	ctx, cancel := ds.roundCtx()
+	defer cancel()
+	leader, ok := paxos.Elect(ctx, ds.acceptor, ds.id, ds.makeRPCList(members))
+	if ok {
+		ds.leader, ds.leaderMembers = leader, members
+	}
+	return ds.leader
+}
+
+// stepDown - forget leader if it is still the current one
+func (ds *store) stepDown(leader *paxos.Leader[Cmd]) {
+	ds.leaderMu.Lock()
+	defer ds.leaderMu.Unlock()
+	if ds.leader == leader {
+		ds.leader, ds.leaderMembers = nil, nil
+	}
+}
+
+// lead - renew the promise if this node is the leader, campaign if the leader has been silent for too long
+func (ds *store) lead() {
+	_, members, rpcList := ds.membership()
+	if leader := ds.getLeader(members); leader != nil {
+		ctx, cancel := ds.roundCtx()
+		renewed := leader.Renew(ctx)
+		cancel()
+		if !renewed {
+			ds.stepDown(leader)
+			return
+		}
+		if ds.memStore.Expiring(time.Now().UnixMilli()) && ds.ticking.CompareAndSwap(false, true) {
+			// advance the committed time so that replicas expire entries and leases
+			go func() {
+				defer ds.ticking.Store(false)
+				ds.propose(ds.updateCtx, makeCmd(nil))
+			}()
+		}
+		return
+	}
+	if !containsMember(members, ds.id) {
+		return
+	}
+	_, renewed := ds.acceptor.Leader()
+	if time.Since(renewed) < ds.electionTimeout {
+		return
+	}
+	ds.electionTimeout = randomElectionTimeout()
+	ctx, cancel := ds.roundCtx()
+	leader, ok := paxos.Elect(ctx, ds.acceptor, ds.id, rpcList)
+	cancel()
+	if !ok {
+		return
+	}
+	ds.leaderMu.Lock()
+	ds.leader, ds.leaderMembers = leader, members
+	ds.leaderMu.Unlock()
+	// write an empty command so that values accepted under previous proposals are committed
+	go ds.propose(ds.updateCtx, makeCmd(nil))
+}
+
+// forward - forward cmd to the leader, the request is abandoned once ctx is done
+// the leader this acceptor has promised is asked first, then the others, as the leader's rounds stop
+// at a quorum and may never reach this acceptor
+func (ds *store) forward(ctx context.Context, cmd Cmd) (Result, bool) {
+	proposal, _ := ds.acceptor.Leader()
+	_, members, rpcList := ds.membership()
+	order := make([]int, 0, len(members))
+	for i, m := range members {
+		switch {
+		case m.Id == ds.id:
+		case proposal != paxos.INITIAL && m.Id == proposal.Proposer():
+			order = append([]int{i}, order...)
+		default:
+			order = append(order, i)
 		}
 	}
-	for {
-		logId := ds.acceptor.Next()
-		value, ok := paxos.Write(ds.acceptor, ds.id, logId, cmd, ds.rpcList)
-		if ok && value.Equal(cmd) {
+	for _, i := range order {
+		res, err := rpc.RPC[setRequest, setResponse](ctx, ds.transport(members[i]), "set", &setRequest{
+			Cmd: cmd,
+		})
+		if err != nil || !res.Ok {
+			if ctx.Err() != nil {
+				return Result{}, false
+			}
+			continue
+		}
+		if ds.acceptor.Next() <= res.Result.LogId {
+			// catch up from the leader so that cmd is visible to following reads on this node
+			_ = paxos.Update(ctx, ds.acceptor, rpcList[i:i+1]) // the update loop reports sync failures
+		}
+		return res.Result, true
+	}
+	return Result{}, false
+}
+
+func (ds *store) handleSet(req *setRequest) *setResponse {
+	result, ok := ds.propose(ds.updateCtx, req.Cmd)
+	return &setResponse{
+		Result: result,
+		Ok:     ok,
+	}
+}
+
+// Set - write cmd, return its committed outcome
+// Set retries until cmd is committed or ctx is done, the error wraps ErrNoQuorum if a quorum is unreachable
+// the quorum is checked after every failed round so that Set fails fast without one,
+// once ctx is done the error reports the last quorum observed within the caller's deadline
+func (ds *store) Set(ctx context.Context, cmd Cmd) (Result, error) {
+	if !validKeys(cmd) {
+		return Result{}, ErrInvalidKey
+	}
+	if cmd.Uuid == uuid.Nil {
+		cmd.Uuid = uuid.New()
+	}
+	backoff := newBackoff(ctx)
+	quorum := true // last quorum observed by a check that completed before ctx was done
+	for round := 0; ; round++ {
+		result, ok := ds.propose(ctx, cmd)
+		if !ok {
+			result, ok = ds.forward(ctx, cmd)
+		}
+		if ok && result.Reused {
+			return result, ErrIdempotencyKeyReused
+		}
+		if ok {
+			return result, nil
+		}
+		if q := ds.hasQuorum(ctx); ctx.Err() == nil {
+			quorum = q
+			if round == 0 && !quorum {
+				return Result{}, ErrNoQuorum
+			}
+		}
+		if !backoff() {
 			break
 		}
-		backoff()
 	}
+	if !quorum {
+		return Result{}, fmt.Errorf("%w: %w", ErrNoQuorum, ctx.Err())
+	}
+	return Result{}, ctx.Err()
+}
+
+// hasQuorum - whether a quorum of acceptors responds within a round
+func (ds *store) hasQuorum(ctx context.Context) bool {
+	_, _, rpcList := ds.membership()
+	roundCtx, cancel := context.WithTimeout(ctx, ROUND_TIMEOUT)
+	defer cancel()
+	_, ok := paxos.ReadIndex(roundCtx, rpcList)
+	return ok
+}
+
+func (ds *store) Get(ctx context.Context, key string, consistency Consistency) (Entry, error) {
+	if err := ds.read(ctx, consistency); err != nil {
+		return Entry{}, err
+	}
+	return ds.memStore.Get(key), nil
 }
 
-func (ds *store) Get(key string) Entry {
-	return ds.memStore.Get(key)
+func (ds *store) Keys(ctx context.Context, consistency Consistency) ([]string, error) {
+	if err := ds.read(ctx, consistency); err != nil {
+		return nil, err
+	}
+	return ds.memStore.Keys(), nil
 }
 
-func (ds *store) Keys() []string {
-	return ds.memStore.Keys()
+func (ds *store) Scan(ctx context.Context, start string, end string, limit int, consistency Consistency) ([]Entry, bool, error) {
+	if err := ds.read(ctx, consistency); err != nil {
+		return nil, false, err
+	}
+	entries, more := ds.memStore.Scan(start, end, limit)
+	return entries, more, nil
+}
+
+// PrefixEnd - smallest key greater than every key with prefix, empty if there is none
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
 }
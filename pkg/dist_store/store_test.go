@@ -0,0 +1,344 @@
+package dist_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"dist_kvstore/pkg/paxos"
+	"dist_kvstore/pkg/rpc"
+)
+
+// TEST_TIMEOUT - deadline of a write or a read that waits for the cluster in tests
+const TEST_TIMEOUT = 10 * time.Second
+
+// testNode - store of a cluster in process, it can be stopped and started again on the same data directory
+type testNode struct {
+	t       *testing.T
+	id      int
+	dir     string
+	addrs   []string
+	joining []int
+	ds      DistStore // nil while stopped
+}
+
+// freeAddrs - n localhost addresses nothing listens on
+func freeAddrs(t *testing.T, n int) []string {
+	t.Helper()
+	addrs := make([]string, 0, n)
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.Addr().String())
+	}
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	return addrs
+}
+
+// testCluster - n nodes in process with plaintext rpc, acceptors in joining only vote once they are added
+func testCluster(t *testing.T, n int, joining ...int) []*testNode {
+	t.Helper()
+	t.Setenv(rpc.RPC_INSECURE_ENV, "true")
+	addrs := freeAddrs(t, n)
+	nodes := make([]*testNode, 0, n)
+	for i := 0; i < n; i++ {
+		node := &testNode{
+			t:       t,
+			id:      i,
+			dir:     filepath.Join(t.TempDir(), fmt.Sprint(i)),
+			addrs:   addrs,
+			joining: joining,
+			ds:      nil,
+		}
+		node.start()
+		t.Cleanup(node.stop)
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (n *testNode) start() {
+	n.t.Helper()
+	ds, err := NewStore(n.id, n.dir, n.addrs, 0, n.joining...)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	go func() {
+		_ = ds.ListenAndServeRPC()
+	}()
+	n.ds = ds
+}
+
+func (n *testNode) stop() {
+	if n.ds == nil {
+		return
+	}
+	_ = n.ds.Close()
+	n.ds = nil
+}
+
+// store - the store of n, to reach its state machine and its leader
+func (n *testNode) store() *store {
+	return n.ds.(*store)
+}
+
+// set - write entries through n, fail the test unless they are applied
+func (n *testNode) set(entries ...Entry) Result {
+	n.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	result, err := n.ds.Set(ctx, makeCmd(entries))
+	if err != nil {
+		n.t.Fatalf("node %d: %v", n.id, err)
+	}
+	if !result.Applied {
+		n.t.Fatalf("node %d: %v not applied", n.id, result.Outcomes)
+	}
+	return result
+}
+
+// get - linearizable read of key through n
+func (n *testNode) get(key string) Entry {
+	n.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	entry, err := n.ds.Get(ctx, key, LINEARIZABLE)
+	if err != nil {
+		n.t.Fatalf("node %d: %v", n.id, err)
+	}
+	return entry
+}
+
+// leader - the node that holds the lease of the leader, wait until one does
+func leader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	for deadline := time.Now().Add(TEST_TIMEOUT); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, n := range nodes {
+			if n.ds != nil && n.store().leased() {
+				return n
+			}
+		}
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	nodes := testCluster(t, 3)
+	lagging := nodes[2]
+	lagging.stop()
+
+	// compact the log of the others past everything the lagging node has
+	for i := 0; i < COMPACT_THRESHOLD+1; i++ {
+		nodes[i%2].set(Put(fmt.Sprint("k", i%10), []byte(fmt.Sprint(i))))
+	}
+	// compaction waits until every reachable acceptor has the log up to the snapshot
+	for _, n := range nodes[:2] {
+		deadline := time.Now().Add(TEST_TIMEOUT)
+		for n.store().acceptor.First() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d has not compacted its log", n.id)
+			}
+			n.store().compact()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	lagging.start()
+	if entry := lagging.get("k0"); string(entry.Val) != fmt.Sprint(COMPACT_THRESHOLD-4) {
+		t.Fatalf("k0 = %q on the lagging node", entry.Val)
+	}
+	if lagging.store().acceptor.First() == 0 {
+		t.Fatal("the lagging node caught up without installing a snapshot")
+	}
+}
+
+// others - nodes except n
+func others(nodes []*testNode, n *testNode) []*testNode {
+	rest := make([]*testNode, 0, len(nodes))
+	for _, o := range nodes {
+		if o != n {
+			rest = append(rest, o)
+		}
+	}
+	return rest
+}
+
+func TestLeaderFailover(t *testing.T) {
+	nodes := testCluster(t, 3)
+	old := leader(t, nodes)
+	old.set(Put("a", []byte("1")))
+
+	// the followers elect another leader and keep every committed write
+	old.stop()
+	rest := others(nodes, old)
+	next := leader(t, rest)
+	if entry := next.get("a"); string(entry.Val) != "1" {
+		t.Fatalf("a = %q on the new leader, want 1", entry.Val)
+	}
+	for _, n := range rest {
+		n.set(Put("a", []byte(fmt.Sprint("from ", n.id))))
+	}
+
+	// the old leader catches up once it is back
+	old.start()
+	if entry := old.get("a"); entry.Ver != 3 {
+		t.Fatalf("a at version %d on the old leader, want 3", entry.Ver)
+	}
+}
+
+func TestMembershipChange(t *testing.T) {
+	nodes := testCluster(t, 4, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	// replace acceptor 0 with acceptor 3
+	err := nodes[1].ds.ChangeMembership(ctx, MembershipChange{
+		Add:    []Member{{Id: 3, Addr: nodes[3].addrs[3]}},
+		Remove: []paxos.ProposerId{0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nodes[1].ds.ChangeMembership(ctx, MembershipChange{
+		Add:    nil,
+		Remove: []paxos.ProposerId{0},
+	}); !errors.Is(err, ErrInvalidMembership) {
+		t.Fatalf("removing a removed acceptor returned %v", err)
+	}
+
+	// a quorum of the new acceptors needs acceptor 3 once 0 and 1 are gone
+	nodes[0].stop()
+	nodes[1].stop()
+	rest := nodes[2:]
+	leader(t, rest).set(Put("a", []byte("1")))
+	for _, n := range rest {
+		if entry := n.get("a"); string(entry.Val) != "1" {
+			t.Fatalf("a = %q on node %d", entry.Val, n.id)
+		}
+		members := n.ds.Members()
+		if len(members) != 3 || members[0].Id != 1 || members[2].Id != 3 {
+			t.Fatalf("node %d has members %v", n.id, members)
+		}
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	nodes := testCluster(t, 3)
+	n := leader(t, nodes)
+	const writes = 64
+	results := make([]Result, writes)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+			defer cancel()
+			result, err := nodes[i%3].ds.Set(ctx, makeCmd([]Entry{Put("a", []byte(fmt.Sprint(i)))}))
+			if err != nil || !result.Applied {
+				t.Errorf("write %d: %v %v", i, result.Outcomes, err)
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// every write gets its own version, in the order of the logIds they are committed at
+	versions := make(map[uint64]bool)
+	for _, r := range results {
+		versions[r.Versions[0]] = true
+		for _, o := range results {
+			if r.LogId < o.LogId && r.Versions[0] >= o.Versions[0] {
+				t.Fatalf("version %d at logId %d, version %d at logId %d", r.Versions[0], r.LogId, o.Versions[0], o.LogId)
+			}
+		}
+	}
+	if len(versions) != writes {
+		t.Fatalf("%d versions for %d writes", len(versions), writes)
+	}
+	if entry := n.get("a"); entry.Ver != writes {
+		t.Fatalf("a at version %d after %d writes", entry.Ver, writes)
+	}
+}
+
+func TestLeaseRead(t *testing.T) {
+	nodes := testCluster(t, 3)
+	n := leader(t, nodes)
+	n.set(Put("a", []byte("1")))
+
+	// the leader holding its lease reads locally, without a round trip that the done ctx would fail
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	entry, err := n.ds.Get(ctx, "a", LINEARIZABLE)
+	if err != nil || string(entry.Val) != "1" {
+		t.Fatalf("leader read a = %q %v", entry.Val, err)
+	}
+	follower := others(nodes, n)[0]
+	if _, err = follower.ds.Get(ctx, "a", LINEARIZABLE); !errors.Is(err, context.Canceled) {
+		t.Fatalf("follower read without asking the leader returned %v", err)
+	}
+	if _, err = follower.ds.Get(ctx, "a", STALE); err != nil {
+		t.Fatalf("stale read on a follower returned %v", err)
+	}
+}
+
+func TestConditionalWrite(t *testing.T) {
+	nodes := testCluster(t, 3)
+	nodes[0].set(Put("a", []byte("1")))
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	stale := uint64(0)
+	result, err := nodes[1].ds.Set(ctx, Cmd{
+		Conds:   []Cond{{Key: "a", Ver: &stale}},
+		Entries: []Entry{Put("b", []byte("2"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Applied {
+		t.Fatal("write applied although its precondition fails")
+	}
+	if entry := nodes[2].get("b"); entry.Ver != 0 {
+		t.Fatalf("b at version %d after a failed precondition", entry.Ver)
+	}
+}
+
+func TestRestartKeepsState(t *testing.T) {
+	nodes := testCluster(t, 3)
+	result := nodes[0].set(Put("a", []byte("1")))
+	for _, n := range nodes {
+		n.get("a")
+	}
+	for _, n := range nodes {
+		n.stop()
+	}
+
+	// the state machine is read back from disk, not rebuilt by replaying the log
+	for _, n := range nodes {
+		n.start()
+		if next := n.store().memStore.Next(); next <= result.LogId {
+			t.Fatalf("node %d restarted at logId %d, want after %d", n.id, next, result.LogId)
+		}
+		if entry := n.store().memStore.Get("a"); string(entry.Val) != "1" {
+			t.Fatalf("a = %q on node %d after restart", entry.Val, n.id)
+		}
+	}
+	nodes[1].set(Put("a", []byte("2")))
+	if entry := nodes[2].get("a"); entry.Ver != 2 {
+		t.Fatalf("a at version %d after a write following the restart", entry.Ver)
+	}
+}
@@ -0,0 +1,179 @@
+package dist_store
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"dist_kvstore/pkg/paxos"
+)
+
+const (
+	// WATCH_HISTORY_SIZE - number of latest log entries with changes kept in memory, a watch resumes from earlier ones
+	// by reading the revisions
+	WATCH_HISTORY_SIZE = 4096
+	// WATCH_BUFFER - a watcher is dropped once this many events wait to be received
+	WATCH_BUFFER = 1024
+)
+
+// ErrCompacted - changes before the requested logId are no longer kept, read the current state and watch from there
+var ErrCompacted = errors.New("changes have been compacted")
+
+// WatchEvent - entries changed by the log entry at LogId, a deleted entry has OP_DELETE
+type WatchEvent struct {
+	LogId   paxos.LogId `json:"log_id"`
+	Entries []Entry     `json:"entries"`
+}
+
+type watcher struct {
+	prefix  string
+	queue   []WatchEvent // events waiting to be received, protected by watchMu
+	backlog int          // events queued when the watch started, they do not count towards WATCH_BUFFER, protected by watchMu
+	dropped bool         // protected by watchMu
+	notify  chan struct{}
+}
+
+func (w *watcher) filter(event WatchEvent) (WatchEvent, bool) {
+	entries := make([]Entry, 0, len(event.Entries))
+	for _, entry := range event.Entries {
+		if strings.HasPrefix(entry.Key, w.prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	return WatchEvent{
+		LogId:   event.LogId,
+		Entries: entries,
+	}, len(entries) > 0
+}
+
+// pushWithoutLock - queue an event, drop the watcher if it does not keep up
+func (w *watcher) pushWithoutLock(event WatchEvent) {
+	if event, ok := w.filter(event); ok {
+		w.queue = append(w.queue, event)
+	}
+	if len(w.queue) > w.backlog+WATCH_BUFFER {
+		w.dropWithoutLock()
+		return
+	}
+	w.wake()
+}
+
+func (w *watcher) dropWithoutLock() {
+	w.queue, w.dropped = nil, true
+	w.wake()
+}
+
+func (w *watcher) wake() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// publish - record changes of an applied log entry and send them to watchers
+func (ds *store) publish(logId paxos.LogId, o outcome) {
+	ds.watchMu.Lock()
+	defer ds.watchMu.Unlock()
+	if o.restored {
+		// changes up to logId are unknown, watchers must read the state again
+		ds.history, ds.historyFrom = nil, logId+1
+		for w := range ds.watchers {
+			w.dropWithoutLock()
+			delete(ds.watchers, w)
+		}
+	}
+	if len(o.changes) == 0 {
+		return
+	}
+	event := WatchEvent{
+		LogId:   logId,
+		Entries: o.changes,
+	}
+	ds.history = append(ds.history, event)
+	if len(ds.history) > WATCH_HISTORY_SIZE {
+		ds.historyFrom = ds.history[0].LogId + 1
+		ds.history = ds.history[1:]
+	}
+	for w := range ds.watchers {
+		w.pushWithoutLock(event)
+		if w.dropped {
+			delete(ds.watchers, w)
+		}
+	}
+}
+
+// Watch - stream changes of keys with prefix committed from fromLogId in order
+// the channel is closed when ctx is done or the watcher falls too far behind, resume from the last LogId received + 1
+// changes before the history in memory are read from the revisions, ErrCompacted if those are no longer kept
+func (ds *store) Watch(ctx context.Context, prefix string, fromLogId paxos.LogId) (<-chan WatchEvent, error) {
+	w := &watcher{
+		prefix:  prefix,
+		queue:   nil,
+		backlog: 0,
+		dropped: false,
+		notify:  make(chan struct{}, 1),
+	}
+	// the history may move on while the revisions are read, read again up to where it starts
+	ds.watchMu.Lock()
+	for fromLogId < ds.historyFrom {
+		historyFrom := ds.historyFrom
+		ds.watchMu.Unlock()
+		events, err := ds.memStore.Changes(prefix, fromLogId, historyFrom)
+		if err != nil {
+			return nil, err
+		}
+		w.queue = append(w.queue, events...)
+		fromLogId = historyFrom
+		ds.watchMu.Lock()
+	}
+	for _, event := range ds.history {
+		if event, ok := w.filter(event); ok && event.LogId >= fromLogId {
+			w.queue = append(w.queue, event)
+		}
+	}
+	w.backlog = len(w.queue)
+	ds.watchers[w] = struct{}{}
+	ds.watchMu.Unlock()
+	w.wake()
+
+	out := make(chan WatchEvent)
+	go func() {
+		defer close(out)
+		defer func() {
+			ds.watchMu.Lock()
+			delete(ds.watchers, w)
+			ds.watchMu.Unlock()
+		}()
+		for {
+			ds.watchMu.Lock()
+			events, dropped := w.queue, w.dropped
+			w.queue, w.backlog = nil, 0
+			ds.watchMu.Unlock()
+			if dropped {
+				return
+			}
+			for _, event := range events {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ds.updateCtx.Done():
+					return
+				case out <- event:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ds.updateCtx.Done():
+				return
+			case <-w.notify:
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Next - smallest logId not applied to the local state machine, watch from it to see changes after a read
+func (ds *store) Next() paxos.LogId {
+	return ds.memStore.Next()
+}
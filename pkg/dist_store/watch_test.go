@@ -0,0 +1,72 @@
+package dist_store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"dist_kvstore/pkg/paxos"
+)
+
+// receive - the next event of ch, fail the test if none arrives in time
+func receive(t *testing.T, ch <-chan WatchEvent) WatchEvent {
+	t.Helper()
+	select {
+	case event, ok := <-ch:
+		if !ok {
+			t.Fatal("watch closed")
+		}
+		return event
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("no event")
+	}
+	return WatchEvent{}
+}
+
+func TestWatchResumesFromRevisions(t *testing.T) {
+	nodes := testCluster(t, 3)
+	put := nodes[0].set(Put("a", []byte("1")))
+	nodes[0].set(Put("b", []byte("2")))
+	del := nodes[0].set(Delete("a"))
+
+	// the restarted node has no history in memory before its last applied logId
+	n := nodes[1]
+	n.get("a")
+	n.stop()
+	n.start()
+	if from := n.store().historyFrom; from <= del.LogId {
+		t.Fatalf("history from %d after restart, want after %d", from, del.LogId)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := n.ds.Watch(ctx, "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := receive(t, ch)
+	if event.LogId != put.LogId || len(event.Entries) != 1 || string(event.Entries[0].Val) != "1" {
+		t.Fatalf("first event %+v, want a = 1 at %d", event, put.LogId)
+	}
+	event = receive(t, ch)
+	if event.LogId != del.LogId || len(event.Entries) != 1 || event.Entries[0].Op != OP_DELETE || event.Entries[0].Ver != 2 {
+		t.Fatalf("second event %+v, want the deletion of a at version 2 at %d", event, del.LogId)
+	}
+	// later changes follow from the history in memory
+	next := nodes[0].set(Put("a", []byte("3")))
+	event = receive(t, ch)
+	if event.LogId != next.LogId || string(event.Entries[0].Val) != "3" {
+		t.Fatalf("third event %+v, want a = 3 at %d", event, next.LogId)
+	}
+
+	n.store().memStore.Compact(del.LogId)
+	if _, err := n.ds.Watch(ctx, "a", del.LogId); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("watch from a compacted logId returned %v", err)
+	}
+	if _, err := n.ds.Watch(ctx, "a", del.LogId+1); err != nil {
+		t.Fatalf("watch after the compacted logId returned %v", err)
+	}
+	if _, err := n.ds.Watch(ctx, "a", paxos.LogId(0)); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("watch from 0 after compaction returned %v", err)
+	}
+}
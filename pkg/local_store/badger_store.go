@@ -89,3 +89,27 @@ func (t *badgerStringTxn) Del(k string) {
 		panic(err)
 	}
 }
+
+func (t *badgerStringTxn) Scan(start string, f func(k string, v string) bool) {
+	prefix := fmt.Sprintf("%s/", t.prefix)
+	it := t.txn.NewIterator(badger.IteratorOptions{
+		PrefetchValues: false,
+		Prefix:         []byte(prefix),
+	})
+	defer it.Close()
+	for it.Seek([]byte(prefix + start)); it.Valid(); it.Next() {
+		item := it.Item()
+		k := strings.TrimPrefix(string(item.Key()), prefix)
+		var v string
+		err := item.Value(func(val []byte) error {
+			v = string(val)
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
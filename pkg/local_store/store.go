@@ -1,5 +1,11 @@
 package local_store
 
+import (
+	"cmp"
+
+	"dist_kvstore/pkg/codec"
+)
+
 type Txn[K comparable, V any] interface {
 	Get(k K) (v V, ok bool)
 	Set(k K, v V)
@@ -16,11 +22,22 @@ type MemStore[K comparable, V any] interface {
 	Keys() []K
 }
 
+// OrderedTxn - Txn whose keys are in order, the Txn of a badger StringStore is an OrderedTxn
+type OrderedTxn[K cmp.Ordered, V any] interface {
+	Txn[K, V]
+	// Scan - call f on entries from the smallest key >= start in order until f returns false
+	Scan(start K, f func(k K, v V) bool)
+}
+
 type StringStore interface {
 	Store[string, string]
 	Append(prefix string) StringStore
 }
 
-func MakeStoreFromStringStore[K comparable, V any](ss StringStore) Store[K, V] {
-	return &storeKV[K, V]{ss: ss}
+// MakeStoreFromStringStore - keys and values are encoded by codec
+func MakeStoreFromStringStore[K comparable, V any](ss StringStore, codec codec.Codec) Store[K, V] {
+	return &storeKV[K, V]{
+		ss:    ss,
+		codec: codec,
+	}
 }
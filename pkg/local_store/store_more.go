@@ -1,6 +1,6 @@
 package local_store
 
-import "encoding/json"
+import "dist_kvstore/pkg/codec"
 
 func zero[T any]() T {
 	var v T
@@ -8,33 +8,38 @@ func zero[T any]() T {
 }
 
 type storeKV[K comparable, V any] struct {
-	ss StringStore
+	ss    StringStore
+	codec codec.Codec
 }
 
 func (s *storeKV[K, V]) Update(update func(txn Txn[K, V]) any) any {
 	var out any
 	s.ss.Update(func(txn Txn[string, string]) any {
-		out = update(&txnKV[K, V]{txn: txn})
+		out = update(&txnKV[K, V]{txn: txn, codec: s.codec})
 		return nil
 	})
 	return out
 }
 
 type txnKV[K comparable, V any] struct {
-	txn Txn[string, string]
+	txn   Txn[string, string]
+	codec codec.Codec
 }
 
-func (t *txnKV[K, V]) Get(k K) (v V, ok bool) {
-	kb, err := json.Marshal(k)
+func (t *txnKV[K, V]) key(k K) string {
+	kb, err := t.codec.Marshal(k)
 	if err != nil {
 		panic(err)
 	}
-	ks := string(kb)
-	vs, ok := t.txn.Get(ks)
+	return string(kb)
+}
+
+func (t *txnKV[K, V]) Get(k K) (v V, ok bool) {
+	vs, ok := t.txn.Get(t.key(k))
 	if !ok {
 		return zero[V](), false
 	}
-	err = json.Unmarshal([]byte(vs), &v)
+	err := t.codec.Unmarshal([]byte(vs), &v)
 	if err != nil {
 		panic(err)
 	}
@@ -42,24 +47,63 @@ func (t *txnKV[K, V]) Get(k K) (v V, ok bool) {
 }
 
 func (t *txnKV[K, V]) Set(k K, v V) {
-	kb, err := json.Marshal(k)
+	vb, err := t.codec.Marshal(v)
 	if err != nil {
 		panic(err)
 	}
-	ks := string(kb)
-	vb, err := json.Marshal(v)
-	if err != nil {
-		panic(err)
-	}
-	vs := string(vb)
-	t.txn.Set(ks, vs)
+	t.txn.Set(t.key(k), string(vb))
 }
 
 func (t *txnKV[K, V]) Del(k K) {
-	kb, err := json.Marshal(k)
-	if err != nil {
-		panic(err)
+	t.txn.Del(t.key(k))
+}
+
+// MIGRATE_BATCH_SIZE - number of entries moved by a single transaction of MigrateStore
+const MIGRATE_BATCH_SIZE = 1024
+
+// MigrateStore - move every entry of from encoded by fromCodec to to encoded by toCodec
+// from and to must be different prefixes of the same ordered StringStore
+// entries are copied before they are deleted from from, so an interrupted migration is finished by calling it again
+func MigrateStore[K comparable, V any](from StringStore, fromCodec codec.Codec, to StringStore, toCodec codec.Codec) {
+	MigrateStoreFunc(from, fromCodec, to, toCodec, func(k K, v V) V {
+		return v
+	})
+}
+
+// MigrateStoreFunc - MigrateStore with every value converted from V in from to W in to
+func MigrateStoreFunc[K comparable, V any, W any](from StringStore, fromCodec codec.Codec, to StringStore, toCodec codec.Codec, convert func(k K, v V) W) {
+	for {
+		batch := make(map[string]string, MIGRATE_BATCH_SIZE)
+		from.Update(func(txn Txn[string, string]) any {
+			txn.(OrderedTxn[string, string]).Scan("", func(k string, v string) bool {
+				batch[k] = v
+				return len(batch) < MIGRATE_BATCH_SIZE
+			})
+			return nil
+		})
+		if len(batch) == 0 {
+			return
+		}
+		to.Update(func(txn Txn[string, string]) any {
+			toTxn := &txnKV[K, W]{txn: txn, codec: toCodec}
+			for ks, vs := range batch {
+				var k K
+				var v V
+				if err := fromCodec.Unmarshal([]byte(ks), &k); err != nil {
+					panic(err)
+				}
+				if err := fromCodec.Unmarshal([]byte(vs), &v); err != nil {
+					panic(err)
+				}
+				toTxn.Set(k, convert(k, v))
+			}
+			return nil
+		})
+		from.Update(func(txn Txn[string, string]) any {
+			for ks := range batch {
+				txn.Del(ks)
+			}
+			return nil
+		})
 	}
-	ks := string(kb)
-	t.txn.Del(ks)
 }
@@ -1,44 +1,90 @@
 package paxos
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
+	"dist_kvstore/pkg/codec"
 	"dist_kvstore/pkg/local_store"
 )
 
+const (
+	SYNC_BATCH_SIZE = 256
+	SYNC_CHUNK_SIZE = 1 << 20
+	// LEASE_DURATION - after promising the leader, reject other proposers for this long
+	LEASE_DURATION = 1000 * time.Millisecond
+	// LEASE_DRIFT - bound of the clock drift between nodes over LEASE_DURATION
+	LEASE_DRIFT = 100 * time.Millisecond
+)
+
 type StateMachine[T any] func(logId LogId, value T)
 
 type Acceptor[T any] interface {
 	// GetValue - get value
 	GetValue(logId LogId) (val T, ok bool)
+	// First - get smallest logId that is still in the log - entries before it are compacted
+	First() LogId
 	// Next - get smallestUnapplied - used to propose
 	Next() LogId
+	// Leader - get the proposal promised to the leader and the last time the leader renewed it
+	Leader() (proposal Proposal, renewed time.Time)
 	// HandleRPC - handle RPC requests
 	HandleRPC(req Request) (res Response)
+	// Compact - replace log entries [First(), logId] by value
+	// value must be the compressed form of those entries, i.e. applying value alone
+	// brings the state machine to the same state as applying all of them
+	// if logId has not been applied, value is installed as a snapshot and applied to the state machine
+	Compact(logId LogId, value T) bool
+	// Install - Compact with the value encoded in snapshot as sent in SyncResponse
+	Install(logId LogId, snapshot []byte) (bool, error)
 	// Subscribe - subscribe a state machine to log
 	// smallestUnapplied is the index when state machine will start getting updates
 	// it ignores all previous log entries
+	// if smallestUnapplied was compacted, the state machine starts from the compressed value at First()
 	Subscribe(smallestUnapplied LogId, sm StateMachine[T]) (cancel func())
 }
 
-func NewAcceptor[T any](log local_store.Store[LogId, Promise[T]]) Acceptor[T] {
-	return (&acceptor[T]{
+// NewAcceptor - meta and snapshots sent to peers are encoded by codec
+func NewAcceptor[T any](log local_store.Store[LogId, Promise[T]], meta local_store.StringStore, codec codec.Codec) Acceptor[T] {
+	a := &acceptor[T]{
 		mu:                sync.Mutex{},
-		acceptor:          &simpleAcceptor[T]{log: log},
+		acceptor:          newSimpleAcceptor(log, meta, codec),
+		codec:             codec,
 		smallestUnapplied: 0,
 		subsciber:         nil,
-	}).applyCommitWithoutLock()
+		snapshot:          nil,
+		renewed:           time.Now(),
+		leaseUntil:        time.Time{},
+	}
+	if a.acceptor.leader != INITIAL {
+		// a lease might have been granted right before restart
+		a.leaseUntil = a.renewed.Add(LEASE_DURATION)
+	}
+	return a.applyCommitWithoutLock()
 }
 
 // acceptor - paxos acceptor must be persistent
 type acceptor[T any] struct {
 	mu                sync.Mutex
 	acceptor          *simpleAcceptor[T]
+	codec             codec.Codec
 	smallestUnapplied LogId
 	subsciber         StateMachine[T]
+	snapshot          []byte    // cache of the encoded value at acceptor.first
+	renewed           time.Time // last time the leader renewed its promise
+	leaseUntil        time.Time // other proposers are rejected until then
+}
+
+// leasedWithoutLock - whether proposal must be rejected because another proposer holds the lease
+func (a *acceptor[T]) leasedWithoutLock(proposal Proposal) bool {
+	return time.Now().Before(a.leaseUntil) && proposal.Proposer() != a.acceptor.leader.Proposer()
 }
 
 func (a *acceptor[T]) applyCommitWithoutLock() *acceptor[T] {
+	if a.smallestUnapplied < a.acceptor.first {
+		a.smallestUnapplied = a.acceptor.first
+	}
 	for {
 		proposal, value := a.acceptor.get(a.smallestUnapplied)
 		if proposal != COMMITTED {
@@ -60,6 +106,7 @@ func (a *acceptor[T]) Subscribe(smallestUnapplied LogId, sm StateMachine[T]) (ca
 	}
 	a.subsciber = sm
 	a.smallestUnapplied = smallestUnapplied
+	a.applyCommitWithoutLock()
 
 	return func() {
 		a.mu.Lock()
@@ -72,23 +119,106 @@ func (a *acceptor[T]) GetValue(logId LogId) (T, bool) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	proposal, value := a.acceptor.get(logId)
-	if proposal == COMMITTED {
+	if proposal == COMMITTED && value != nil {
 		return *value, true
 	}
 	return zero[T](), false
 }
 
+func (a *acceptor[T]) First() LogId {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.acceptor.first
+}
+
 func (a *acceptor[T]) Next() LogId {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	return a.applyCommitWithoutLock().smallestUnapplied
 }
 
+func (a *acceptor[T]) Leader() (Proposal, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.acceptor.leader, a.renewed
+}
+
+func (a *acceptor[T]) Compact(logId LogId, value T) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if logId < a.acceptor.first {
+		return false
+	}
+	a.acceptor.compact(logId, value)
+	a.snapshot = nil
+	if logId >= a.smallestUnapplied {
+		// install snapshot
+		a.smallestUnapplied = logId
+		a.applyCommitWithoutLock()
+	}
+	return true
+}
+
+func (a *acceptor[T]) Install(logId LogId, snapshot []byte) (bool, error) {
+	var value T
+	if err := a.codec.Unmarshal(snapshot, &value); err != nil {
+		return false, err
+	}
+	return a.Compact(logId, value), nil
+}
+
+func (a *acceptor[T]) syncWithoutLock(logId LogId, offset int) (*SyncResponse[T], error) {
+	first := a.acceptor.first
+	if first > 0 && logId <= first {
+		// send snapshot
+		if a.snapshot == nil {
+			_, value := a.acceptor.get(first)
+			b, err := a.codec.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("encode snapshot at logId %d: %w", first, err)
+			}
+			a.snapshot = b
+		}
+		begin := min(offset, len(a.snapshot))
+		end := min(begin+SYNC_CHUNK_SIZE, len(a.snapshot))
+		return &SyncResponse[T]{
+			First:    first,
+			Snapshot: a.snapshot[begin:end],
+			Size:     len(a.snapshot),
+			Values:   nil,
+		}, nil
+	}
+	values := make([]T, 0)
+	for ; len(values) < SYNC_BATCH_SIZE; logId++ {
+		proposal, value := a.acceptor.get(logId)
+		if proposal != COMMITTED {
+			break
+		}
+		values = append(values, *value)
+	}
+	return &SyncResponse[T]{
+		First:    first,
+		Snapshot: nil,
+		Size:     0,
+		Values:   values,
+	}, nil
+}
+
 func (a *acceptor[T]) HandleRPC(r Request) Response {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	switch req := r.(type) {
 	case *PrepareRequest:
+		if a.leasedWithoutLock(req.Proposal) {
+			return &PrepareResponse[T]{
+				Promise: Promise[T]{
+					Proposal: a.acceptor.leader,
+					Accepted: INITIAL,
+					Value:    nil,
+				},
+				Ok: false,
+			}
+		}
 		promise, ok := a.acceptor.prepare(req.LogId, req.Proposal)
 		return &PrepareResponse[T]{
 			Promise: promise,
@@ -110,6 +240,36 @@ func (a *acceptor[T]) HandleRPC(r Request) Response {
 			Proposal: proposal,
 			Value:    value,
 		}
+	case *LeadRequest:
+		if a.leasedWithoutLock(req.Proposal) {
+			return &LeadResponse[T]{
+				Proposal: a.acceptor.leader,
+				Promises: nil,
+				Ok:       false,
+			}
+		}
+		promises, ok := a.acceptor.lead(req.LogId, req.Proposal)
+		if ok {
+			a.renewed = time.Now()
+			a.leaseUntil = a.renewed.Add(LEASE_DURATION)
+		}
+		return &LeadResponse[T]{
+			Proposal: a.acceptor.leader,
+			Promises: promises,
+			Ok:       ok,
+		}
+	case *SyncRequest:
+		res, err := a.syncWithoutLock(req.LogId, req.Offset)
+		if err != nil {
+			fmt.Println(fmt.Errorf("sync from logId %d: %w", req.LogId, err))
+			return nil // the peer syncs from another acceptor
+		}
+		return res
+	case *NextRequest:
+		return &NextResponse{
+			LogId: a.applyCommitWithoutLock().smallestUnapplied,
+			Last:  a.acceptor.last,
+		}
 	default:
 		return nil
 	}
@@ -0,0 +1,147 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"dist_kvstore/pkg/codec"
+	"dist_kvstore/pkg/local_store"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// newTestAcceptor - acceptor in a badger in a temporary directory, snapshots are encoded in JSON
+func newTestAcceptor(t *testing.T) Acceptor[string] {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	ss := local_store.NewBadgerStringStore(db)
+	return NewAcceptor(
+		local_store.MakeStoreFromStringStore[LogId, Promise[string]](ss.Append("log"), codec.JSON),
+		ss.Append("acceptor"),
+		codec.JSON,
+	)
+}
+
+// testPeer - acceptor reached in process, a peer that is down does not respond
+type testPeer struct {
+	mu       sync.RWMutex // held by requests in flight, the test closes the acceptor under the write lock
+	acceptor Acceptor[string]
+	down     atomic.Bool
+}
+
+func (p *testPeer) rpc(ctx context.Context, req Request, resCh chan<- Response) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.down.Load() {
+		resCh <- nil
+		return
+	}
+	resCh <- p.acceptor.HandleRPC(req)
+}
+
+// stop - take p down for good and wait for requests in flight, commits are broadcast in the background
+func (p *testPeer) stop() {
+	p.down.Store(true)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+}
+
+// testCluster - n peers, every peer reaches the others in process
+func testCluster(t *testing.T, n int) ([]*testPeer, []RPC) {
+	t.Helper()
+	peers := make([]*testPeer, 0, n)
+	rpcList := make([]RPC, 0, n)
+	for i := 0; i < n; i++ {
+		p := &testPeer{
+			mu:       sync.RWMutex{},
+			acceptor: newTestAcceptor(t),
+			down:     atomic.Bool{},
+		}
+		t.Cleanup(p.stop) // runs before the acceptor is closed
+		peers = append(peers, p)
+		rpcList = append(rpcList, p.rpc)
+	}
+	return peers, rpcList
+}
+
+// appliedValues - subscribe to a and collect the values it applies
+func appliedValues(a Acceptor[string]) func() map[LogId]string {
+	mu := sync.Mutex{}
+	applied := make(map[LogId]string)
+	a.Subscribe(0, func(logId LogId, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		applied[logId] = value
+	})
+	return func() map[LogId]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return applied
+	}
+}
+
+func TestUpdateInstallsSnapshot(t *testing.T) {
+	peers, _ := testCluster(t, 1)
+	source := peers[0].acceptor
+	for logId := LogId(0); logId < 10; logId++ {
+		source.HandleRPC(&CommitRequest[string]{
+			LogId: logId,
+			Value: fmt.Sprint(logId),
+		})
+	}
+	snapshot := strings.Repeat("s", 2*SYNC_CHUNK_SIZE) // sent in three chunks once encoded
+	if !source.Compact(5, snapshot) {
+		t.Fatal("compact failed")
+	}
+
+	a := newTestAcceptor(t)
+	applied := appliedValues(a)
+	if err := Update(context.Background(), a, []RPC{peers[0].rpc}); err != nil {
+		t.Fatal(err)
+	}
+	if a.First() != 5 || a.Next() != 10 {
+		t.Fatalf("first %d next %d after sync, want 5 10", a.First(), a.Next())
+	}
+	got := applied()
+	if len(got) != 5 || got[5] != snapshot || got[9] != "9" {
+		t.Fatalf("applied %d values, want the snapshot at 5 and the values 6 to 9", len(got))
+	}
+}
+
+func TestUpdateReportsSnapshotThatCannotBeInstalled(t *testing.T) {
+	corrupt := func(ctx context.Context, req Request, resCh chan<- Response) {
+		switch req.(type) {
+		case *NextRequest:
+			resCh <- &NextResponse{
+				LogId: 10,
+				Last:  9,
+			}
+		case *SyncRequest:
+			resCh <- &SyncResponse[string]{
+				First:    5,
+				Snapshot: []byte("{"),
+				Size:     1,
+				Values:   nil,
+			}
+		default:
+			resCh <- nil
+		}
+	}
+	a := newTestAcceptor(t)
+	if err := Update(context.Background(), a, []RPC{corrupt}); err == nil {
+		t.Fatal("no error for a snapshot that cannot be decoded")
+	}
+	if a.First() != 0 || a.Next() != 0 {
+		t.Fatalf("first %d next %d after a failed install, want 0 0", a.First(), a.Next())
+	}
+}
@@ -0,0 +1,179 @@
+package paxos
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Leader - distinguished proposer, a quorum has promised its proposal for all logIds
+// so it skips the prepare phase and only sends AcceptRequest for each write
+type Leader[T any] struct {
+	mu       sync.Mutex
+	acceptor Acceptor[T]
+	rpcList  []RPC
+	proposal Proposal
+	values   map[LogId]T // values accepted under previous proposals, they must be written again
+	lease    time.Time   // a quorum rejects other proposers until then
+}
+
+// Elect - try to become the leader for all logIds from a.Next()
+func Elect[T any](ctx context.Context, a Acceptor[T], id ProposerId, rpcList []RPC) (*Leader[T], bool) {
+	quorum := len(rpcList)/2 + 1
+	logId := a.Next()
+	proposal, _ := a.Leader()
+	// try once more above the largest promise reported by peers
+	for attempt := 0; attempt < 2; attempt++ {
+		round, _ := decompose(proposal)
+		proposal = compose(round+1, id)
+		start := time.Now()
+		resList := broadcast(ctx, rpcList, &LeadRequest{
+			LogId:    logId,
+			Proposal: proposal,
+		}, quorumOf(rpcList, func(res *LeadResponse[T]) bool {
+			return res.Ok
+		}))
+		okCount := 0
+		maxProposal := Proposal(0)
+		promises := make(map[LogId]Promise[T])
+		for _, res := range resList {
+			maxProposal = max(maxProposal, res.Proposal)
+			if !res.Ok {
+				continue
+			}
+			okCount++
+			for i, p := range res.Promises {
+				if q, ok := promises[i]; !ok || q.Accepted <= p.Accepted {
+					promises[i] = p
+				}
+			}
+		}
+		if okCount >= quorum {
+			values := make(map[LogId]T)
+			for i, p := range promises {
+				values[i] = *p.Value
+			}
+			return &Leader[T]{
+				mu:       sync.Mutex{},
+				acceptor: a,
+				rpcList:  rpcList,
+				proposal: proposal,
+				values:   values,
+				lease:    leaseFrom(start),
+			}, true
+		}
+		if maxProposal <= proposal {
+			break
+		}
+		proposal = maxProposal
+	}
+	return nil, false
+}
+
+// leaseFrom - the lease granted by acceptors to a LeadRequest sent at start
+// acceptors start counting when they receive it so the leader's lease ends earlier than theirs
+func leaseFrom(start time.Time) time.Time {
+	return start.Add(LEASE_DURATION - LEASE_DRIFT)
+}
+
+// Leased - whether no other proposer can be elected or commit a value until the lease expires
+func (l *Leader[T]) Leased() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.lease)
+}
+
+// Renew - renew the promise and the lease, return false if the leader has been deposed
+func (l *Leader[T]) Renew(ctx context.Context) bool {
+	quorum := len(l.rpcList)/2 + 1
+	start := time.Now()
+	okCount := 0
+	for _, res := range broadcast(ctx, l.rpcList, &LeadRequest{
+		LogId:    l.acceptor.Next(),
+		Proposal: l.proposal,
+	}, quorumOf(l.rpcList, func(res *LeadResponse[T]) bool {
+		return res.Ok
+	})) {
+		if res.Ok {
+			okCount++
+		}
+	}
+	if okCount < quorum {
+		return false
+	}
+	l.mu.Lock()
+	l.lease = leaseFrom(start)
+	l.mu.Unlock()
+	return true
+}
+
+// Recovering - whether values accepted under previous proposals remain to be written from logId
+func (l *Leader[T]) Recovering(logId LogId) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.values {
+		if i >= logId {
+			return true
+		}
+	}
+	return false
+}
+
+// Write - write new value with a single accept round
+// Write can be called concurrently for different logIds
+// if a value was accepted at logId under a previous proposal, that value is written instead
+// return false if logId has been committed, the leader has been deposed or ctx is done before a quorum has accepted
+func (l *Leader[T]) Write(ctx context.Context, logId LogId, value T) (T, bool) {
+	quorum := len(l.rpcList)/2 + 1
+	a := l.acceptor
+	if logId < a.First() {
+		return zero[T](), false
+	}
+	if _, committed := a.GetValue(logId); committed {
+		return zero[T](), false
+	}
+	l.mu.Lock()
+	if v, ok := l.values[logId]; ok {
+		value = v
+	}
+	l.mu.Unlock()
+
+	resList := broadcast(ctx, l.rpcList, &AcceptRequest[T]{
+		LogId:    logId,
+		Proposal: l.proposal,
+		Value:    value,
+	}, quorumOf(l.rpcList, func(res *AcceptResponse[T]) bool {
+		return res.Ok
+	}))
+	okCount := 0
+	for _, res := range resList {
+		if res.Ok {
+			okCount++
+			continue
+		}
+		if res.Promise.Proposal == COMMITTED && res.Promise.Value != nil {
+			// logId has been committed, learn its value
+			a.HandleRPC(&CommitRequest[T]{
+				LogId: logId,
+				Value: *res.Promise.Value,
+			})
+			return zero[T](), false
+		}
+	}
+	if okCount < quorum {
+		return zero[T](), false
+	}
+	// commit
+	go broadcastCommit(l.rpcList, &CommitRequest[T]{
+		LogId: logId,
+		Value: value,
+	})
+	a.HandleRPC(&CommitRequest[T]{
+		LogId: logId,
+		Value: value,
+	})
+	l.mu.Lock()
+	delete(l.values, logId)
+	l.mu.Unlock()
+	return value, true
+}
@@ -0,0 +1,81 @@
+package paxos
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaderFailover(t *testing.T) {
+	peers, rpcList := testCluster(t, 3)
+	ctx := context.Background()
+	l, ok := Elect(ctx, peers[0].acceptor, 1, rpcList)
+	if !ok {
+		t.Fatal("first leader not elected")
+	}
+	if v, ok := l.Write(ctx, 0, "a"); !ok || v != "a" {
+		t.Fatalf("write at 0 returned %q %v", v, ok)
+	}
+	// a quorum accepts b at 1 but the leader fails before committing it
+	for _, p := range peers[:2] {
+		res := p.acceptor.HandleRPC(&AcceptRequest[string]{
+			LogId:    1,
+			Proposal: l.proposal,
+			Value:    "b",
+		}).(*AcceptResponse[string])
+		if !res.Ok {
+			t.Fatal("accept under the leader's proposal rejected")
+		}
+	}
+	peers[0].down.Store(true)
+
+	if _, ok := Elect(ctx, peers[2].acceptor, 3, rpcList); ok {
+		t.Fatal("elected while the first leader's lease holds")
+	}
+	time.Sleep(LEASE_DURATION)
+	next, ok := Elect(ctx, peers[2].acceptor, 3, rpcList)
+	if !ok {
+		t.Fatal("no leader elected after the lease expired")
+	}
+	if !next.Recovering(1) {
+		t.Fatal("the value accepted by a quorum is not recovered")
+	}
+	if v, ok := next.Write(ctx, 1, "c"); !ok || v != "b" {
+		t.Fatalf("write at 1 returned %q %v, want the accepted value b", v, ok)
+	}
+	if v, ok := next.Write(ctx, 2, "c"); !ok || v != "c" {
+		t.Fatalf("write at 2 returned %q %v", v, ok)
+	}
+	if _, ok := l.Write(ctx, 3, "d"); ok {
+		t.Fatal("the deposed leader wrote a value")
+	}
+}
+
+func TestRejectedAccept(t *testing.T) {
+	a := newTestAcceptor(t)
+	lead := a.HandleRPC(&LeadRequest{
+		LogId:    0,
+		Proposal: compose(2, 1),
+	}).(*LeadResponse[string])
+	if !lead.Ok {
+		t.Fatal("lead request rejected")
+	}
+	res := a.HandleRPC(&AcceptRequest[string]{
+		LogId:    5,
+		Proposal: compose(1, 2),
+		Value:    "stale",
+	}).(*AcceptResponse[string])
+	if res.Ok {
+		t.Fatal("accept below the promised proposal succeeded")
+	}
+	if res.Promise.Proposal != compose(2, 1) {
+		t.Fatalf("rejection reports proposal %d, want the promise %d", res.Promise.Proposal, compose(2, 1))
+	}
+	if next := a.HandleRPC(&NextRequest{}).(*NextResponse); next.Last != 0 {
+		t.Fatalf("last %d after a rejected accept, want 0", next.Last)
+	}
+	poll := a.HandleRPC(&PollRequest{LogId: 5}).(*PollResponse[string])
+	if poll.Value != nil {
+		t.Fatalf("rejected value %q stored", *poll.Value)
+	}
+}
@@ -42,3 +42,37 @@ type PollResponse[T any] struct {
 	Proposal Proposal `json:"proposal"`
 	Value    *T       `json:"value"`
 }
+
+type NextRequest struct {
+}
+
+type NextResponse struct {
+	LogId LogId `json:"log_id"`
+	Last  LogId `json:"last"` // largest logId that has been accepted or committed
+}
+
+// SyncRequest - request committed values from LogId
+// if LogId has been compacted, the compressed value at First() is sent in chunks from Offset instead
+type SyncRequest struct {
+	LogId  LogId `json:"log_id"`
+	Offset int   `json:"offset"`
+}
+
+type SyncResponse[T any] struct {
+	First    LogId  `json:"first"`
+	Snapshot []byte `json:"snapshot"` // chunk of the value at First encoded by the codec of the acceptor
+	Size     int    `json:"size"`     // size of the encoded value at First, zero if no snapshot is sent
+	Values   []T    `json:"values"`   // committed values from LogId
+}
+
+// LeadRequest - promise Proposal for all logIds, the leader renews its promise by sending it again
+type LeadRequest struct {
+	LogId    LogId    `json:"log_id"`
+	Proposal Proposal `json:"proposal"`
+}
+
+type LeadResponse[T any] struct {
+	Proposal Proposal             `json:"proposal"` // promise to the leader
+	Promises map[LogId]Promise[T] `json:"promises"` // accepted values from LogId
+	Ok       bool                 `json:"ok"`
+}
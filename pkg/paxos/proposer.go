@@ -1,16 +1,19 @@
 package paxos
 
 import (
-	"math/rand"
+	"context"
+	"fmt"
 	"time"
 )
 
 type ProposerId uint64
 
 const (
-	PROPOSAL_STEP    = 4294967296
-	BACKOFF_MIN_TIME = 10 * time.Millisecond
-	BACKOFF_MAX_TIME = 1000 * time.Millisecond
+	PROPOSAL_STEP = 4294967296
+	// COMMIT_TIMEOUT - deadline of commits broadcast in the background
+	COMMIT_TIMEOUT = 10 * time.Second
+	// SYNC_TIMEOUT - deadline of the poll of Update and of every request to a peer it syncs from
+	SYNC_TIMEOUT = 1000 * time.Millisecond
 )
 
 type Round uint64
@@ -23,151 +26,196 @@ func decompose(proposal Proposal) (Round, ProposerId) {
 	return Round(proposal / PROPOSAL_STEP), ProposerId(proposal % PROPOSAL_STEP)
 }
 
-type RPC func(Request, chan<- Response)
+// Proposer - get the id of the proposer that made the proposal
+func (p Proposal) Proposer() ProposerId {
+	_, id := decompose(p)
+	return id
+}
+
+// RPC - send a request to a peer and put its response or nil into the channel, the request is abandoned once ctx is done
+type RPC func(ctx context.Context, req Request, resCh chan<- Response)
 
-func broadcast[Req any, Res any](rpcList []RPC, req Req) []Res {
-	ch := make(chan Response, len(rpcList))
-	defer close(ch)
+// broadcast - send req to every peer concurrently, return the responses once enough holds for them,
+// every peer has responded or ctx is done, requests still in flight are cancelled
+// enough is nil to wait for every peer
+func broadcast[Req any, Res any](ctx context.Context, rpcList []RPC, req Req, enough func(resList []Res) bool) []Res {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan Response, len(rpcList)) // late responses are left in the buffer
 	for _, rpc := range rpcList {
-		rpc(req, ch)
+		go rpc(ctx, req, ch)
 	}
 	resList := make([]Res, 0, len(rpcList))
 	for range rpcList {
-		res := <-ch
-		if res == nil {
-			continue
+		select {
+		case <-ctx.Done():
+			return resList
+		case res := <-ch:
+			if res == nil {
+				continue
+			}
+			resList = append(resList, res.(Res))
+			if enough != nil && enough(resList) {
+				return resList
+			}
 		}
-		resList = append(resList, res.(Res))
 	}
 	return resList
 }
 
-// Update - check if there is an update
-func Update[T any](a Acceptor[T], rpcList []RPC) Acceptor[T] {
-	for {
-		logId := a.Next()
-		commited := false
-		var v T
-		for _, res := range broadcast[*PollRequest, *PollResponse[T]](rpcList, &PollRequest{
-			LogId: logId,
-		}) {
-			if res.Proposal == COMMITTED {
-				v = *res.Value
-				commited = true
-				break
+// quorumOf - enough for broadcast once a quorum of rpcList has responded ok
+func quorumOf[Res any](rpcList []RPC, ok func(res Res) bool) func(resList []Res) bool {
+	quorum := len(rpcList)/2 + 1
+	return func(resList []Res) bool {
+		okCount := 0
+		for _, res := range resList {
+			if ok(res) {
+				okCount++
 			}
 		}
-		if !commited {
-			break
-		}
-		a.HandleRPC(&CommitRequest[T]{
-			LogId: logId,
-			Value: v,
-		})
+		return okCount >= quorum
 	}
-	return a
 }
 
-// Write - write new value
-func Write[T any](a Acceptor[T], id ProposerId, logId LogId, value T, rpcList []RPC) (T, bool) {
-	quorum := len(rpcList)/2 + 1
-	round := Round(1)
-
-	wait := BACKOFF_MIN_TIME
-	// exponential backoff
-	backoff := func() {
-		round++
-		a = Update(a, rpcList)
-		time.Sleep(time.Duration(rand.Intn(int(wait))))
-		wait *= 2
-		if wait > BACKOFF_MAX_TIME {
-			wait = BACKOFF_MAX_TIME
-		}
+// broadcastCommit - send a commit to every peer in the background
+func broadcastCommit[T any](rpcList []RPC, req *CommitRequest[T]) {
+	ctx, cancel := context.WithTimeout(context.Background(), COMMIT_TIMEOUT)
+	defer cancel()
+	broadcast[*CommitRequest[T], *CommitResponse](ctx, rpcList, req, nil)
+}
+
+// call - send request to a single peer
+func call[Req any, Res any](ctx context.Context, rpc RPC, req Req) (Res, bool) {
+	resList := broadcast[Req, Res](ctx, []RPC{rpc}, req, nil)
+	if len(resList) == 0 {
+		return zero[Res](), false
 	}
-	for {
-		if _, committed := a.GetValue(logId); committed {
-			return zero[T](), false
-		}
-		// prepare
-		proposal := compose(round, id)
-		maxValuePtr, ok := func() (*T, bool) {
-			maxPromise := Proposal(0)
-			maxValuePtr := (*T)(nil)
-			okCount := 0
-			resList := broadcast[*PrepareRequest, *PrepareResponse[T]](rpcList, &PrepareRequest{
-				LogId:    logId,
-				Proposal: proposal,
-			})
-			for _, res := range resList {
-				if res.Ok {
-					okCount++
-					if res.Promise.Value != nil {
-						if maxPromise <= res.Promise.Proposal {
-							maxPromise = res.Promise.Proposal
-							maxValuePtr = res.Promise.Value
-						}
-					}
-				}
+	return resList[0], true
+}
+
+// Update - catch up with peers, they are asked for their progress concurrently
+// and committed values are fetched from every peer that is ahead as soon as it responds
+// return once a quorum has responded and a has caught up with them, every peer has responded or ctx is done
+// the poll and every request of a sync have their own SYNC_TIMEOUT, so a slow peer or a large snapshot
+// does not use up the time of the others, ctx bounds the whole update
+// the error is that of the last snapshot that could not be installed, a is caught up from the other peers anyway
+func Update[T any](ctx context.Context, a Acceptor[T], rpcList []RPC) error {
+	pollCtx, cancel := context.WithTimeout(ctx, SYNC_TIMEOUT)
+	defer cancel()
+	type progress struct {
+		rpc  RPC
+		next LogId
+		ok   bool
+	}
+	ch := make(chan progress, len(rpcList))
+	for _, rpc := range rpcList {
+		go func() {
+			res, ok := call[*NextRequest, *NextResponse](pollCtx, rpc, &NextRequest{})
+			p := progress{
+				rpc:  rpc,
+				next: 0,
+				ok:   ok,
+			}
+			if ok {
+				p.next = res.LogId
 			}
-			return maxValuePtr, okCount >= quorum
+			ch <- p
 		}()
-
-		if !ok {
-			backoff()
+	}
+	quorum := len(rpcList)/2 + 1
+	okCount := 0
+	var lastErr error
+	for range rpcList {
+		p := <-ch // every poll ends by pollCtx
+		if !p.ok {
 			continue
 		}
-		// accept
-		if maxValuePtr == nil {
-			maxValuePtr = &value
+		okCount++
+		for a.Next() < p.next {
+			synced, err := syncFrom(ctx, a, p.rpc)
+			if err != nil {
+				lastErr = err
+			}
+			if !synced {
+				break
+			}
 		}
+		if okCount >= quorum || ctx.Err() != nil {
+			return lastErr
+		}
+	}
+	return lastErr
+}
 
-		ok = func() bool {
-			resList := broadcast[*AcceptRequest[T], *AcceptResponse[T]](rpcList, &AcceptRequest[T]{
-				LogId:    logId,
-				Proposal: proposal,
-				Value:    *maxValuePtr,
-			})
-			okCount := 0
-			for _, res := range resList {
-				if res.Ok {
-					okCount++
-				}
+// syncFrom - fetch committed values or snapshot from a peer, return false if there is nothing new
+// every request has its own SYNC_TIMEOUT, a snapshot is received in chunks until ctx is done
+// the error is set if the snapshot received cannot be installed
+func syncFrom[T any](ctx context.Context, a Acceptor[T], rpc RPC) (bool, error) {
+	logId := a.Next()
+	request := func(offset int) (*SyncResponse[T], bool) {
+		ctx, cancel := context.WithTimeout(ctx, SYNC_TIMEOUT)
+		defer cancel()
+		return call[*SyncRequest, *SyncResponse[T]](ctx, rpc, &SyncRequest{
+			LogId:  logId,
+			Offset: offset,
+		})
+	}
+	res, ok := request(0)
+	if !ok {
+		return false, nil
+	}
+	if res.Size > 0 {
+		// logId has been compacted on the peer, receive snapshot in chunks
+		first, b := res.First, res.Snapshot
+		for len(b) < res.Size {
+			res, ok = request(len(b))
+			if !ok || res.First != first || len(res.Snapshot) == 0 {
+				return false, nil // peer compacted again in the middle of the transfer
 			}
-			return okCount >= quorum
-		}()
-		if !ok {
-			backoff()
-			continue
+			b = append(b, res.Snapshot...)
 		}
-		// commit
-		func() {
-			// broadcast commit
-			go broadcast[*CommitRequest[T], *CommitResponse](rpcList, &CommitRequest[T]{
-				LogId: logId,
-				Value: *maxValuePtr,
-			})
-			// local commit
-			a.HandleRPC(&CommitRequest[T]{
-				LogId: logId,
-				Value: *maxValuePtr,
-			})
-		}()
-		return *maxValuePtr, true
+		ok, err := a.Install(first, b)
+		if err != nil {
+			return false, fmt.Errorf("install snapshot at logId %d: %w", first, err)
+		}
+		return ok, nil
+	}
+	for i, value := range res.Values {
+		a.HandleRPC(&CommitRequest[T]{
+			LogId: logId + LogId(i),
+			Value: value,
+		})
 	}
+	return len(res.Values) > 0, nil
 }
 
-func LogCompact[T any](rpcList []RPC) {
-	// TODO
-	// 1. send request to get smallest logId
-	// 2. emit log compaction request
-	// 3. T is a sum type of Command CompressedCommand.
-	//    compact log entries [0, 1, 2, 3, ...] -> [x, 2, 3, ...]
-	//    where x stores CompressedCommand
-	// 4. StateMachine applies CompressedCommand is recovering from snapshot
-	// 5. initLogId is used to restore the StateMachine
-
-	/*
+// LogCompact - compact log entries [First(), logId] into value
+// unreachable peers catch up from the snapshot later, the log is only compacted if every reachable peer
+// has applied logId to avoid unnecessary snapshot transfers
+// peers that have not responded before ctx is done are unreachable
+func LogCompact[T any](ctx context.Context, a Acceptor[T], logId LogId, value T, rpcList []RPC) bool {
+	resList := broadcast[*NextRequest, *NextResponse](ctx, rpcList, &NextRequest{}, nil)
+	for _, res := range resList {
+		if res.LogId <= logId {
+			return false
+		}
+	}
+	return a.Compact(logId, value)
+}
 
-	 */
-	// compressLog[T any](ts ...T) T // type signature for log compression where T is type of value
+// ReadIndex - get a logId such that every value committed before the call is at or before it
+// every committed value has been accepted by a quorum so the largest accepted logId of any quorum covers it
+func ReadIndex(ctx context.Context, rpcList []RPC) (LogId, bool) {
+	quorum := len(rpcList)/2 + 1
+	resList := broadcast(ctx, rpcList, &NextRequest{}, quorumOf(rpcList, func(res *NextResponse) bool {
+		return true
+	}))
+	if len(resList) < quorum {
+		return 0, false
+	}
+	readIndex := LogId(0)
+	for _, res := range resList {
+		readIndex = max(readIndex, res.Last)
+	}
+	return readIndex, true
 }
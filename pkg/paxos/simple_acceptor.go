@@ -1,6 +1,9 @@
 package paxos
 
-import "dist_kvstore/pkg/local_store"
+import (
+	"dist_kvstore/pkg/codec"
+	"dist_kvstore/pkg/local_store"
+)
 
 // Proposal - roundId * 4294967296 + nodeId
 type Proposal uint64
@@ -15,6 +18,7 @@ const (
 // Promise - promise to reject all PREPARE if proposal <= this and all ACCEPT if proposal < this
 type Promise[T any] struct {
 	Proposal Proposal `json:"proposal"`
+	Accepted Proposal `json:"accepted"` // proposal of the accepted value
 	Value    *T       `json:"value"`
 }
 
@@ -23,8 +27,78 @@ func zero[T any]() T {
 	return v
 }
 
+const (
+	TRIM_BATCH_SIZE = 1024
+	META_FIRST      = "first"
+	META_TRIM       = "trim"
+	META_LAST       = "last"
+	META_LEAD       = "lead"
+)
+
+// simpleAcceptor - log entries before first are compacted
+// the entry at first holds the compressed form of all log entries up to first
 type simpleAcceptor[T any] struct {
-	log local_store.Store[LogId, Promise[T]]
+	log      local_store.Store[LogId, Promise[T]]
+	meta     local_store.Store[string, LogId]
+	metaLead local_store.Store[string, Proposal]
+	first    LogId
+	last     LogId    // largest logId that has been accepted or committed
+	leader   Proposal // promise to the leader for all logIds
+}
+
+func newSimpleAcceptor[T any](log local_store.Store[LogId, Promise[T]], meta local_store.StringStore, codec codec.Codec) *simpleAcceptor[T] {
+	a := &simpleAcceptor[T]{
+		log:      log,
+		meta:     local_store.MakeStoreFromStringStore[string, LogId](meta, codec),
+		metaLead: local_store.MakeStoreFromStringStore[string, Proposal](meta, codec),
+		first:    0,
+		last:     0,
+		leader:   INITIAL,
+	}
+	a.first = a.getMeta(META_FIRST)
+	a.last = a.getMeta(META_LAST)
+	a.leader = a.metaLead.Update(func(txn local_store.Txn[string, Proposal]) any {
+		v, ok := txn.Get(META_LEAD)
+		if !ok {
+			return INITIAL
+		}
+		return v
+	}).(Proposal)
+	a.trim() // finish trimming if it was interrupted
+	return a
+}
+
+func (a *simpleAcceptor[T]) getMeta(key string) LogId {
+	return a.meta.Update(func(txn local_store.Txn[string, LogId]) any {
+		v, ok := txn.Get(key)
+		if !ok {
+			return LogId(0)
+		}
+		return v
+	}).(LogId)
+}
+
+func (a *simpleAcceptor[T]) setMeta(key string, v LogId) {
+	a.meta.Update(func(txn local_store.Txn[string, LogId]) any {
+		txn.Set(key, v)
+		return nil
+	})
+}
+
+// touch - persist last before a value is written at logId
+func (a *simpleAcceptor[T]) touch(logId LogId) {
+	if logId > a.last {
+		a.setMeta(META_LAST, logId)
+		a.last = logId
+	}
+}
+
+// promised - promise of a log entry taking the promise to the leader into account
+func (a *simpleAcceptor[T]) promised(p Promise[T]) Promise[T] {
+	if p.Proposal < a.leader {
+		p.Proposal = a.leader
+	}
+	return p
 }
 
 func getDefaultLogEntry[T any](txn local_store.Txn[LogId, Promise[T]], logId LogId) (p Promise[T]) {
@@ -32,6 +106,7 @@ func getDefaultLogEntry[T any](txn local_store.Txn[LogId, Promise[T]], logId Log
 	if !ok {
 		return Promise[T]{
 			Proposal: INITIAL,
+			Accepted: INITIAL,
 			Value:    nil,
 		}
 	}
@@ -39,6 +114,9 @@ func getDefaultLogEntry[T any](txn local_store.Txn[LogId, Promise[T]], logId Log
 }
 
 func (a *simpleAcceptor[T]) get(logId LogId) (Proposal, *T) {
+	if logId < a.first {
+		return COMMITTED, nil // compacted
+	}
 	promise := a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
 		return getDefaultLogEntry(txn, logId)
 	}).(Promise[T])
@@ -46,9 +124,17 @@ func (a *simpleAcceptor[T]) get(logId LogId) (Proposal, *T) {
 }
 
 func (a *simpleAcceptor[T]) commit(logId LogId, v T) {
+	if logId < a.first {
+		return
+	}
+	a.touch(logId)
 	a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
+		if getDefaultLogEntry(txn, logId).Proposal == COMMITTED {
+			return nil // committed value never changes, it might have been replaced by a compressed value
+		}
 		txn.Set(logId, Promise[T]{
 			Proposal: COMMITTED,
+			Accepted: COMMITTED,
 			Value:    &v,
 		})
 		return nil
@@ -56,13 +142,21 @@ func (a *simpleAcceptor[T]) commit(logId LogId, v T) {
 }
 
 func (a *simpleAcceptor[T]) prepare(logId LogId, proposal Proposal) (Promise[T], bool) {
+	if logId < a.first {
+		return Promise[T]{
+			Proposal: COMMITTED,
+			Accepted: COMMITTED,
+			Value:    nil,
+		}, false
+	}
 	r := a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
-		p := getDefaultLogEntry(txn, logId)
+		p := a.promised(getDefaultLogEntry(txn, logId))
 		if !(p.Proposal < proposal) {
 			return [2]any{p, false}
 		}
 		txn.Set(logId, Promise[T]{
 			Proposal: proposal,
+			Accepted: p.Accepted,
 			Value:    p.Value,
 		})
 		return [2]any{p, true}
@@ -72,17 +166,89 @@ func (a *simpleAcceptor[T]) prepare(logId LogId, proposal Proposal) (Promise[T],
 }
 
 func (a *simpleAcceptor[T]) accept(logId LogId, proposal Proposal, value T) (Promise[T], bool) {
-	r := a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
-		p := getDefaultLogEntry(txn, logId)
-		if !(p.Proposal <= proposal) {
-			return [2]any{p, false}
-		}
+	if logId < a.first {
+		return Promise[T]{
+			Proposal: COMMITTED,
+			Accepted: COMMITTED,
+			Value:    nil,
+		}, false
+	}
+	p := a.promised(a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
+		return getDefaultLogEntry(txn, logId)
+	}).(Promise[T]))
+	if !(p.Proposal <= proposal) {
+		return p, false
+	}
+	// raise last only for an accepted value, HandleRPC holds the lock from the check to the write
+	a.touch(logId)
+	a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
 		txn.Set(logId, Promise[T]{
 			Proposal: proposal,
+			Accepted: proposal,
 			Value:    &value,
 		})
-		return [2]any{p, true}
-	}).([2]any)
-	promise, ok := r[0].(Promise[T]), r[1].(bool)
-	return promise, ok
+		return nil
+	})
+	return p, true
+}
+
+// lead - promise proposal for all logIds, return accepted values from logId
+// the leader renews its promise by sending the same proposal again
+func (a *simpleAcceptor[T]) lead(logId LogId, proposal Proposal) (map[LogId]Promise[T], bool) {
+	if proposal < a.leader {
+		return nil, false
+	}
+	if proposal > a.leader {
+		a.metaLead.Update(func(txn local_store.Txn[string, Proposal]) any {
+			txn.Set(META_LEAD, proposal)
+			return nil
+		})
+		a.leader = proposal
+	}
+	promises := make(map[LogId]Promise[T])
+	a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
+		for i := max(logId, a.first); i <= a.last; i++ {
+			p := getDefaultLogEntry(txn, i)
+			if p.Value != nil {
+				promises[i] = p
+			}
+		}
+		return nil
+	})
+	return promises, true
+}
+
+// compact - replace log entries [first, logId] by v
+func (a *simpleAcceptor[T]) compact(logId LogId, v T) {
+	a.touch(logId)
+	a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
+		txn.Set(logId, Promise[T]{
+			Proposal: COMMITTED,
+			Accepted: COMMITTED,
+			Value:    &v,
+		})
+		return nil
+	})
+	a.setMeta(META_FIRST, logId)
+	a.first = logId
+	a.trim()
+}
+
+// trim - delete compacted log entries in batches
+// trim is persisted after every batch so that an interrupted trim can be resumed
+func (a *simpleAcceptor[T]) trim() {
+	for {
+		from := a.getMeta(META_TRIM)
+		if from >= a.first {
+			return
+		}
+		to := min(from+TRIM_BATCH_SIZE, a.first)
+		a.log.Update(func(txn local_store.Txn[LogId, Promise[T]]) any {
+			for logId := from; logId < to; logId++ {
+				txn.Del(logId)
+			}
+			return nil
+		})
+		a.setMeta(META_TRIM, to)
+	}
 }
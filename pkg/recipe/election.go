@@ -0,0 +1,138 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+
+	"dist_kvstore/pkg/dist_store"
+	"dist_kvstore/pkg/paxos"
+)
+
+// ErrNoLeader - nobody is campaigning
+var ErrNoLeader = errors.New("no leader")
+
+// Election - campaigns on prefix, the earliest campaign that has not resigned is the leader
+// the leader resigns when its session expires
+type Election struct {
+	s      *Session
+	prefix string
+	w      *waiter // nil while not campaigning
+}
+
+func NewElection(s *Session, prefix string) *Election {
+	return &Election{
+		s:      s,
+		prefix: prefix,
+		w:      nil,
+	}
+}
+
+// Campaign - wait until elected with val, leave the queue if ctx is done
+func (e *Election) Campaign(ctx context.Context, val string) error {
+	w, err := enqueue(ctx, e.s, e.prefix, val)
+	if err != nil {
+		return err
+	}
+	err = w.wait(ctx, waitPredecessor)
+	if err != nil {
+		_ = w.dequeue(context.Background())
+		return err
+	}
+	e.w = w
+	return nil
+}
+
+// Resign - give up leadership so that the next campaign is elected
+func (e *Election) Resign(ctx context.Context) error {
+	if e.w == nil {
+		return ErrNotLocked
+	}
+	err := e.w.dequeue(ctx)
+	e.w = nil
+	return err
+}
+
+// Token - fencing token of the leader, it is larger for every later leader
+func (e *Election) Token() paxos.LogId {
+	if e.w == nil {
+		return 0
+	}
+	return e.w.token
+}
+
+// Guard - precondition that holds while this client is the leader
+func (e *Election) Guard() (dist_store.Cond, error) {
+	if e.w == nil {
+		return dist_store.Cond{}, ErrNotLocked
+	}
+	return e.w.guard(), nil
+}
+
+// Leader - value of the current leader
+func (e *Election) Leader(ctx context.Context) (string, error) {
+	entry, ok, err := e.leader(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNoLeader
+	}
+	return string(entry.Val), nil
+}
+
+func (e *Election) leader(ctx context.Context) (dist_store.Entry, bool, error) {
+	queue, err := readQueue(ctx, e.s.ds, e.prefix)
+	if err != nil || len(queue) == 0 {
+		return dist_store.Entry{}, false, err
+	}
+	return queue[0], true, nil
+}
+
+// Observe - stream the value of every new leader, empty while there is none
+// the channel is closed when ctx is done or the leader cannot be read
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		last, first := "", true
+		for {
+			from := e.s.ds.Next()
+			leader, _, err := e.leader(ctx)
+			if err != nil {
+				return
+			}
+			if first || leader.Key != last {
+				select {
+				case <-ctx.Done():
+					return
+				case out <- string(leader.Val):
+				}
+				last, first = leader.Key, false
+			}
+			err = e.waitChange(ctx, from)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// waitChange - wait until the queue changes at or after logId from
+func (e *Election) waitChange(ctx context.Context, from paxos.LogId) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := e.s.ds.Watch(watchCtx, queuePrefix(e.prefix), from)
+	if errors.Is(err, dist_store.ErrCompacted) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ch:
+		return nil
+	}
+}
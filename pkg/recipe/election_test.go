@@ -0,0 +1,71 @@
+package recipe
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// observed - next leader value of ch, fail the test if none arrives in time
+func observed(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case v, ok := <-ch:
+		if !ok {
+			t.Fatal("observe closed")
+		}
+		return v
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("no leader observed")
+	}
+	return ""
+}
+
+func TestElection(t *testing.T) {
+	ds := newTestStore(t)
+	s1, client := newTestSession(t, ds)
+	s2, _ := newTestSession(t, ds)
+	s3, _ := newTestSession(t, ds)
+	e1, e2, e3 := NewElection(s1, "leader"), NewElection(s2, "leader"), NewElection(s3, "leader")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := e1.Leader(ctx); err != ErrNoLeader {
+		t.Fatalf("leader before any campaign: %v", err)
+	}
+	observe := e3.Observe(ctx)
+	if v := observed(t, observe); v != "" {
+		t.Fatalf("observed %q before any campaign", v)
+	}
+
+	acquired(t, lock(func(ctx context.Context) error {
+		return e1.Campaign(ctx, "a")
+	}))
+	if v := observed(t, observe); v != "a" {
+		t.Fatalf("observed %q, want a", v)
+	}
+	second := lock(func(ctx context.Context) error {
+		return e2.Campaign(ctx, "b")
+	})
+	waitQueued(t, ds, "leader", 2)
+	blocked(t, second)
+	if v, err := e2.Leader(ctx); err != nil || v != "a" {
+		t.Fatalf("leader is %q %v, want a", v, err)
+	}
+
+	// the leader resigns when its session expires
+	client.partitioned.Store(true)
+	acquired(t, second)
+	if v := observed(t, observe); v != "b" {
+		t.Fatalf("observed %q, want b", v)
+	}
+	if e2.Token() <= e1.Token() {
+		t.Fatalf("token %d after the previous leader's %d", e2.Token(), e1.Token())
+	}
+	if err := e2.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v := observed(t, observe); v != "" {
+		t.Fatalf("observed %q once every campaign has resigned", v)
+	}
+}
@@ -0,0 +1,70 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"dist_kvstore/pkg/dist_store"
+	"dist_kvstore/pkg/paxos"
+)
+
+// ErrNotLocked - the lock is not held by this client
+var ErrNotLocked = errors.New("not locked")
+
+// Mutex - fair lock on prefix, waiters acquire it in the order of arrival
+// the lock is released when the session expires, holders must stop once s.Done() is closed
+type Mutex struct {
+	s      *Session
+	prefix string
+	w      *waiter // nil while not locked
+}
+
+func NewMutex(s *Session, prefix string) *Mutex {
+	return &Mutex{
+		s:      s,
+		prefix: prefix,
+		w:      nil,
+	}
+}
+
+// Lock - wait until every earlier waiter has released the lock, leave the queue if ctx is done
+func (m *Mutex) Lock(ctx context.Context) error {
+	w, err := enqueue(ctx, m.s, m.prefix, fmt.Sprint(m.s.lease))
+	if err != nil {
+		return err
+	}
+	err = w.wait(ctx, waitPredecessor)
+	if err != nil {
+		_ = w.dequeue(context.Background())
+		return err
+	}
+	m.w = w
+	return nil
+}
+
+func (m *Mutex) Unlock(ctx context.Context) error {
+	if m.w == nil {
+		return ErrNotLocked
+	}
+	err := m.w.dequeue(ctx)
+	m.w = nil
+	return err
+}
+
+// Token - fencing token of the holder, it is larger for every later holder
+// downstream systems reject requests with a token smaller than the largest one they have seen
+func (m *Mutex) Token() paxos.LogId {
+	if m.w == nil {
+		return 0
+	}
+	return m.w.token
+}
+
+// Guard - precondition that holds while the lock is held, add it to Conds of writes that only the holder may apply
+func (m *Mutex) Guard() (dist_store.Cond, error) {
+	if m.w == nil {
+		return dist_store.Cond{}, ErrNotLocked
+	}
+	return m.w.guard(), nil
+}
@@ -0,0 +1,74 @@
+package recipe
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMutexFairOrder(t *testing.T) {
+	ds := newTestStore(t)
+	mutexes := make([]*Mutex, 0, 3)
+	for i := 0; i < 3; i++ {
+		s, _ := newTestSession(t, ds)
+		mutexes = append(mutexes, NewMutex(s, "lock"))
+	}
+	acquired(t, lock(mutexes[0].Lock))
+	second := lock(mutexes[1].Lock)
+	waitQueued(t, ds, "lock", 2)
+	third := lock(mutexes[2].Lock)
+	waitQueued(t, ds, "lock", 3)
+	blocked(t, second)
+	blocked(t, third)
+
+	// every holder has a larger fencing token than the previous one
+	token := mutexes[0].Token()
+	for i, next := range []<-chan error{second, third} {
+		if err := mutexes[i].Unlock(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		acquired(t, next)
+		if i == 0 {
+			blocked(t, third)
+		}
+		if mutexes[i+1].Token() <= token {
+			t.Fatalf("holder %d has token %d after %d", i+1, mutexes[i+1].Token(), token)
+		}
+		token = mutexes[i+1].Token()
+	}
+	if err := mutexes[0].Unlock(context.Background()); err != ErrNotLocked {
+		t.Fatalf("unlock of a released mutex returned %v", err)
+	}
+}
+
+func TestMutexReleasedOnSessionExpiry(t *testing.T) {
+	ds := newTestStore(t)
+	s1, client := newTestSession(t, ds)
+	s2, _ := newTestSession(t, ds)
+	m1, m2 := NewMutex(s1, "lock"), NewMutex(s2, "lock")
+	acquired(t, lock(m1.Lock))
+	guard, err := m1.Guard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !guarded(t, ds, guard) {
+		t.Fatal("write guarded by the held lock not applied")
+	}
+	second := lock(m2.Lock)
+	waitQueued(t, ds, "lock", 2)
+	blocked(t, second)
+
+	// the holder stops renewing, the lock passes on once its lease expires
+	client.partitioned.Store(true)
+	acquired(t, second)
+	select {
+	case <-s1.Done():
+	default:
+		t.Fatal("lock passed on while the session of the previous holder is not done")
+	}
+	if guarded(t, ds, guard) {
+		t.Fatal("write guarded by the expired lock applied")
+	}
+	if m2.Token() <= m1.Token() {
+		t.Fatalf("token %d after the expired holder's %d", m2.Token(), m1.Token())
+	}
+}
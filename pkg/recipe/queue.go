@@ -0,0 +1,177 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"dist_kvstore/pkg/dist_store"
+	"dist_kvstore/pkg/paxos"
+)
+
+// waiter - key of a session in the queue of a prefix
+// prefix/seq counts arrivals, prefix/q/<seq> are the waiters in the order of arrival
+type waiter struct {
+	s      *Session
+	prefix string
+	key    string
+	token  paxos.LogId // logId the key has been written at
+}
+
+func seqKey(prefix string) string {
+	return prefix + "/seq"
+}
+
+func queuePrefix(prefix string) string {
+	return prefix + "/q/"
+}
+
+// enqueue - append a key with val attached to the lease of s to the queue of prefix
+func enqueue(ctx context.Context, s *Session, prefix string, val string) (*waiter, error) {
+	for {
+		select {
+		case <-s.Done():
+			return nil, ErrSessionExpired
+		default:
+		}
+		seq, err := s.ds.Get(ctx, seqKey(prefix), dist_store.LINEARIZABLE)
+		if err != nil {
+			return nil, err
+		}
+		ver := seq.Ver
+		key := fmt.Sprintf("%s%020d", queuePrefix(prefix), ver+1)
+		result, err := s.ds.Set(ctx, dist_store.Cmd{
+			Conds: []dist_store.Cond{{
+				Key: seqKey(prefix),
+				Ver: &ver,
+			}},
+			Entries: []dist_store.Entry{
+				{
+					Key: seqKey(prefix),
+					Val: []byte("seq"),
+					Ver: ver + 1,
+				},
+				{
+					Key:   key,
+					Val:   []byte(val),
+					Lease: s.lease,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.Applied {
+			return &waiter{
+				s:      s,
+				prefix: prefix,
+				key:    key,
+				token:  result.LogId,
+			}, nil
+		}
+		if result.Entries[0].Ver == ver {
+			return nil, ErrSessionExpired // the precondition holds, the lease does not exist
+		}
+	}
+}
+
+// readQueue - get the waiters of prefix in the order of arrival
+func readQueue(ctx context.Context, ds dist_store.DistStore, prefix string) ([]dist_store.Entry, error) {
+	start, end := queuePrefix(prefix), dist_store.PrefixEnd(queuePrefix(prefix))
+	queue := make([]dist_store.Entry, 0)
+	for {
+		entries, more, err := ds.Scan(ctx, start, end, dist_store.SCAN_LIMIT, dist_store.LINEARIZABLE)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, entries...)
+		if !more {
+			return queue, nil
+		}
+		start = entries[len(entries)-1].Key + "\x00"
+	}
+}
+
+// waitDeleted - wait until key is deleted at or after logId from
+func waitDeleted(ctx context.Context, s *Session, key string, from paxos.LogId) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := s.ds.Watch(watchCtx, key, from)
+	if errors.Is(err, dist_store.ErrCompacted) {
+		return nil // read the queue again
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.Done():
+			return ErrSessionExpired
+		case event, ok := <-ch:
+			if !ok {
+				return nil // the watch has been dropped, read the queue again
+			}
+			for _, entry := range event.Entries {
+				if entry.Key == key && entry.Op == dist_store.OP_DELETE {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// wait - wait until blocker finds no key before the waiter in the queue
+// blocker gets the queue and the index of the waiter, it returns the key to wait for or an empty string
+func (w *waiter) wait(ctx context.Context, blocker func(queue []dist_store.Entry, i int) string) error {
+	for {
+		from := w.s.ds.Next()
+		queue, err := readQueue(ctx, w.s.ds, w.prefix)
+		if err != nil {
+			return err
+		}
+		i := -1
+		for j, entry := range queue {
+			if entry.Key == w.key {
+				i = j
+			}
+		}
+		if i < 0 {
+			return ErrSessionExpired // the key has been deleted with the lease
+		}
+		key := blocker(queue, i)
+		if len(key) == 0 {
+			return nil
+		}
+		err = waitDeleted(ctx, w.s, key, from)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dequeue - delete the key of the waiter
+func (w *waiter) dequeue(ctx context.Context) error {
+	_, err := w.s.ds.Set(ctx, dist_store.Cmd{
+		Entries: []dist_store.Entry{dist_store.Delete(w.key)},
+	})
+	return err
+}
+
+// guard - precondition that holds while the key of the waiter exists
+func (w *waiter) guard() dist_store.Cond {
+	ver := uint64(1)
+	return dist_store.Cond{
+		Key: w.key,
+		Ver: &ver,
+	}
+}
+
+// waitPredecessor - blocker of exclusive holders, wait until every earlier waiter is gone
+func waitPredecessor(queue []dist_store.Entry, i int) string {
+	if i == 0 {
+		return ""
+	}
+	return queue[i-1].Key
+}
@@ -0,0 +1,57 @@
+package recipe
+
+import (
+	"context"
+	"testing"
+
+	"dist_kvstore/pkg/dist_store"
+)
+
+func TestBlockers(t *testing.T) {
+	queue := []dist_store.Entry{
+		{Key: "q/1", Val: []byte(READER)},
+		{Key: "q/2", Val: []byte(WRITER)},
+		{Key: "q/3", Val: []byte(READER)},
+		{Key: "q/4", Val: []byte(READER)},
+	}
+	for i, want := range []string{"", "q/1", "q/2", "q/3"} {
+		if got := waitPredecessor(queue, i); got != want {
+			t.Fatalf("waiter %d waits for %q, want %q", i, got, want)
+		}
+	}
+	for i, want := range []string{"", "", "q/2", "q/2"} {
+		if got := waitWriter(queue, i); got != want {
+			t.Fatalf("reader %d waits for %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestEnqueueOrder(t *testing.T) {
+	ds := newTestStore(t)
+	s, _ := newTestSession(t, ds)
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	waiters := make([]*waiter, 0, 3)
+	for _, val := range []string{"a", "b", "c"} {
+		w, err := enqueue(ctx, s, "queue", val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waiters = append(waiters, w)
+	}
+	if err := waiters[1].dequeue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	queue, err := readQueue(ctx, ds, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].Key != waiters[0].key || queue[1].Key != waiters[2].key {
+		t.Fatalf("queue %v after dequeuing the second waiter", queue)
+	}
+	for i := 1; i < len(waiters); i++ {
+		if waiters[i].token <= waiters[i-1].token {
+			t.Fatalf("waiter %d has token %d after %d", i, waiters[i].token, waiters[i-1].token)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package recipe
+
+import (
+	"context"
+
+	"dist_kvstore/pkg/dist_store"
+	"dist_kvstore/pkg/paxos"
+)
+
+const (
+	READER = "r"
+	WRITER = "w"
+)
+
+// RWMutex - fair read/write lock on prefix, readers share the lock until a writer arrives
+// and waiters acquire it in the order of arrival
+type RWMutex struct {
+	s      *Session
+	prefix string
+	w      *waiter // nil while not locked
+}
+
+func NewRWMutex(s *Session, prefix string) *RWMutex {
+	return &RWMutex{
+		s:      s,
+		prefix: prefix,
+		w:      nil,
+	}
+}
+
+// waitWriter - blocker of readers, wait until every earlier writer is gone
+func waitWriter(queue []dist_store.Entry, i int) string {
+	for j := i - 1; j >= 0; j-- {
+		if string(queue[j].Val) == WRITER {
+			return queue[j].Key
+		}
+	}
+	return ""
+}
+
+func (m *RWMutex) lock(ctx context.Context, val string, blocker func(queue []dist_store.Entry, i int) string) error {
+	w, err := enqueue(ctx, m.s, m.prefix, val)
+	if err != nil {
+		return err
+	}
+	err = w.wait(ctx, blocker)
+	if err != nil {
+		_ = w.dequeue(context.Background())
+		return err
+	}
+	m.w = w
+	return nil
+}
+
+// RLock - wait until every earlier writer has released the lock
+func (m *RWMutex) RLock(ctx context.Context) error {
+	return m.lock(ctx, READER, waitWriter)
+}
+
+// Lock - wait until every earlier reader and writer has released the lock
+func (m *RWMutex) Lock(ctx context.Context) error {
+	return m.lock(ctx, WRITER, waitPredecessor)
+}
+
+// Unlock - release a read or a write lock
+func (m *RWMutex) Unlock(ctx context.Context) error {
+	if m.w == nil {
+		return ErrNotLocked
+	}
+	err := m.w.dequeue(ctx)
+	m.w = nil
+	return err
+}
+
+// Token - fencing token of the holder, a writer has a larger token than every earlier holder
+func (m *RWMutex) Token() paxos.LogId {
+	if m.w == nil {
+		return 0
+	}
+	return m.w.token
+}
+
+// Guard - precondition that holds while the lock is held
+func (m *RWMutex) Guard() (dist_store.Cond, error) {
+	if m.w == nil {
+		return dist_store.Cond{}, ErrNotLocked
+	}
+	return m.w.guard(), nil
+}
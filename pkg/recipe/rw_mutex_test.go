@@ -0,0 +1,44 @@
+package recipe
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRWMutex(t *testing.T) {
+	ds := newTestStore(t)
+	mutexes := make([]*RWMutex, 0, 4)
+	for i := 0; i < 4; i++ {
+		s, _ := newTestSession(t, ds)
+		mutexes = append(mutexes, NewRWMutex(s, "rw"))
+	}
+	// readers share the lock
+	acquired(t, lock(mutexes[0].RLock))
+	acquired(t, lock(mutexes[1].RLock))
+	// a writer waits for both, a reader arriving after it waits for the writer
+	writer := lock(mutexes[2].Lock)
+	waitQueued(t, ds, "rw", 3)
+	reader := lock(mutexes[3].RLock)
+	waitQueued(t, ds, "rw", 4)
+	blocked(t, writer)
+	blocked(t, reader)
+
+	if err := mutexes[0].Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	blocked(t, writer)
+	if err := mutexes[1].Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	acquired(t, writer)
+	blocked(t, reader)
+	for _, m := range mutexes[:2] {
+		if mutexes[2].Token() <= m.Token() {
+			t.Fatalf("writer has token %d after a reader's %d", mutexes[2].Token(), m.Token())
+		}
+	}
+	if err := mutexes[2].Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	acquired(t, reader)
+}
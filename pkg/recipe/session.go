@@ -0,0 +1,117 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"dist_kvstore/pkg/dist_store"
+)
+
+// ErrSessionExpired - the lease of the session has expired, every key attached to it has been deleted
+var ErrSessionExpired = errors.New("session has expired")
+
+// ErrSessionTTL - leases are granted in milliseconds, a shorter ttl would be sent as 0
+var ErrSessionTTL = errors.New("session ttl is less than 1ms")
+
+// Session - lease kept alive in the background, keys written by locks and elections are attached to it
+// so that they are deleted once the client stops renewing it
+type Session struct {
+	ds     dist_store.DistStore
+	lease  dist_store.LeaseId
+	ttl    time.Duration
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	done   chan struct{} // closed once the lease has expired or the session has been closed
+}
+
+// NewSession - grant a lease with ttl and keep it alive every ttl/3 until Close, ErrSessionTTL if ttl is less than 1ms
+func NewSession(ctx context.Context, ds dist_store.DistStore, ttl time.Duration) (*Session, error) {
+	if ttl < time.Millisecond {
+		return nil, ErrSessionTTL
+	}
+	cmd := dist_store.Cmd{
+		Grant: []dist_store.Lease{{
+			Id:  0,
+			TTL: ttl.Milliseconds(),
+		}},
+	}
+	start := time.Now() // the lease is granted for ttl from a committed time after start
+	result, err := ds.Set(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		ds:     ds,
+		lease:  result.Leases[0].Id,
+		ttl:    ttl,
+		cancel: cancel,
+		wg:     sync.WaitGroup{},
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.keepAlive(keepAliveCtx, start.Add(ttl))
+	return s, nil
+}
+
+// keepAlive - renew the lease every ttl/3, Done is closed at expireAt unless a renewal has extended it
+// the lease may have expired by then, holders must not assume they still hold anything
+func (s *Session) keepAlive(ctx context.Context, expireAt time.Time) {
+	defer s.wg.Done()
+	defer close(s.done)
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	expiry := time.NewTimer(time.Until(expireAt))
+	defer expiry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-expiry.C:
+			return
+		case <-ticker.C:
+		}
+		sent := time.Now() // the lease is renewed for ttl from a committed time after sent
+		deadline := sent.Add(s.ttl / 3)
+		if expireAt.Before(deadline) {
+			deadline = expireAt
+		}
+		renewCtx, cancel := context.WithDeadline(ctx, deadline)
+		result, err := s.ds.Set(renewCtx, dist_store.Cmd{
+			Grant: []dist_store.Lease{{
+				Id:  s.lease,
+				TTL: 0,
+			}},
+		})
+		cancel()
+		switch {
+		case err == nil && result.Applied:
+			expireAt = sent.Add(s.ttl)
+			expiry.Reset(time.Until(expireAt))
+		case err == nil:
+			return // expired
+		}
+	}
+}
+
+// Lease - lease the keys of the session are attached to
+func (s *Session) Lease() dist_store.LeaseId {
+	return s.lease
+}
+
+// Done - closed once the lease has expired or the session has been closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close - stop renewing and revoke the lease, every lock and campaign of the session is released
+func (s *Session) Close(ctx context.Context) error {
+	s.cancel()
+	s.wg.Wait()
+	_, err := s.ds.Set(ctx, dist_store.Cmd{
+		Revoke: []dist_store.LeaseId{s.lease},
+	})
+	return err
+}
@@ -0,0 +1,177 @@
+package recipe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dist_kvstore/pkg/dist_store"
+	"dist_kvstore/pkg/rpc"
+)
+
+const (
+	// TEST_TIMEOUT - deadline of every step that waits for the store in tests
+	TEST_TIMEOUT = 10 * time.Second
+	// TEST_TTL - ttl of sessions in tests
+	TEST_TTL = 1 * time.Second
+)
+
+// testStore - store as seen by one client, whose writes fail while it is partitioned
+type testStore struct {
+	dist_store.DistStore
+	partitioned atomic.Bool
+}
+
+func (ds *testStore) Set(ctx context.Context, cmd dist_store.Cmd) (dist_store.Result, error) {
+	if ds.partitioned.Load() {
+		<-ctx.Done()
+		return dist_store.Result{}, errors.Join(dist_store.ErrNoQuorum, ctx.Err())
+	}
+	return ds.DistStore.Set(ctx, cmd)
+}
+
+// newTestStore - single acceptor store in process
+func newTestStore(t *testing.T) dist_store.DistStore {
+	t.Helper()
+	t.Setenv(rpc.RPC_INSECURE_ENV, "true")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	ds, err := dist_store.NewStore(0, t.TempDir(), []string{addr}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = ds.ListenAndServeRPC()
+	}()
+	t.Cleanup(func() {
+		_ = ds.Close()
+	})
+	// a session is granted for ttl from before its grant, wait for the election so that it is not expired by then
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	if _, err = ds.Set(ctx, dist_store.Cmd{}); err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+// newTestSession - session with TEST_TTL of a client of ds, closed when the test ends
+func newTestSession(t *testing.T, ds dist_store.DistStore) (*Session, *testStore) {
+	t.Helper()
+	client := &testStore{
+		DistStore:   ds,
+		partitioned: atomic.Bool{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	s, err := NewSession(ctx, client, TEST_TTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.partitioned.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+		defer cancel()
+		_ = s.Close(ctx)
+	})
+	return s, client
+}
+
+// lock - run f in the background, its error is sent once it returns
+func lock(f func(ctx context.Context) error) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+		defer cancel()
+		done <- f(ctx)
+	}()
+	return done
+}
+
+// acquired - wait for the result of a lock, fail the test if it has not returned in time
+func acquired(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("lock not acquired")
+	}
+}
+
+// blocked - the lock has not returned yet
+func blocked(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("lock acquired while held: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// waitQueued - wait until n waiters are in the queue of prefix
+func waitQueued(t *testing.T, ds dist_store.DistStore, prefix string, n int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	for {
+		queue, err := readQueue(ctx, ds, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queue) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// guarded - whether a write guarded by cond is applied
+func guarded(t *testing.T, ds dist_store.DistStore, cond dist_store.Cond) bool {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	result, err := ds.Set(ctx, dist_store.Cmd{
+		Conds:   []dist_store.Cond{cond},
+		Entries: []dist_store.Entry{dist_store.Put("guarded", []byte("1"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.Applied
+}
+
+func TestNewSessionTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, 2, time.Millisecond - 1} {
+		if _, err := NewSession(context.Background(), nil, ttl); !errors.Is(err, ErrSessionTTL) {
+			t.Fatalf("session with ttl %s: %v", ttl, err)
+		}
+	}
+}
+
+func TestSessionDoneOnExpiry(t *testing.T) {
+	ds := newTestStore(t)
+	s, client := newTestSession(t, ds)
+	select {
+	case <-s.Done():
+		t.Fatal("session done while kept alive")
+	case <-time.After(2 * TEST_TTL):
+	}
+
+	// the last renewal has been sent before the partition, Done is closed within ttl of it
+	client.partitioned.Store(true)
+	select {
+	case <-s.Done():
+	case <-time.After(TEST_TTL + TEST_TTL/2):
+		t.Fatal("session not done once its lease may have expired")
+	}
+}
@@ -0,0 +1,296 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"dist_kvstore/pkg/codec"
+)
+
+// frames of version 1:
+// hello    - version of the sender, 0, empty cmd, answered by a rejected frame before the first request to a peer
+// request  - version, codec id, uvarint length of cmd, cmd, request encoded by the codec
+// response - version, codec id, response encoded by the codec
+// rejected - version of the receiver, 0, ids of the codecs it accepts
+// a frame starting with '{' is a JSON message of version 0, sent by nodes before protocol versions
+// they close the connection on a hello as on any frame they cannot parse
+const (
+	PROTOCOL_VERSION byte = 1
+	CODEC_REJECTED   byte = 0
+	// NEGOTIATE_INTERVAL - a peer that has negotiated an older protocol is greeted again after this
+	NEGOTIATE_INTERVAL = time.Minute
+	RPC_CODEC_ENV      = "DIST_KVSTORE_RPC_CODEC"
+)
+
+// Codec - encoding of messages, Id identifies it on the wire and must not be 0
+type Codec interface {
+	codec.Codec
+	Id() byte
+}
+
+type wireCodec struct {
+	codec.Codec
+	id byte
+}
+
+func (c wireCodec) Id() byte {
+	return c.id
+}
+
+func NewCodec(c codec.Codec, id byte) Codec {
+	if id == CODEC_REJECTED {
+		panic("codec id must not be 0")
+	}
+	return wireCodec{
+		Codec: c,
+		id:    id,
+	}
+}
+
+var (
+	JSON_CODEC = NewCodec(codec.JSON, 1)
+	// BINARY_CODEC - its id follows codec.BINARY_SCHEMA, peers of different schemas negotiate JSON_CODEC
+	BINARY_CODEC = NewCodec(codec.BINARY, 1+codec.BINARY_SCHEMA)
+	// CODECS - codecs a dispatcher accepts by default in the order transports prefer them
+	CODECS = []Codec{BINARY_CODEC, JSON_CODEC}
+)
+
+// ErrUnsupported - the peer accepts none of the protocols of this node
+var ErrUnsupported = errors.New("unsupported protocol")
+
+// getCodec - codec named in the environment, BINARY_CODEC by default
+func getCodec() Codec {
+	if os.Getenv(RPC_CODEC_ENV) == "json" {
+		return JSON_CODEC
+	}
+	return BINARY_CODEC
+}
+
+func encodeRequest(version byte, c Codec, cmd string, req any) ([]byte, error) {
+	if version == 0 {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(message{
+			Cmd:  cmd,
+			Body: body,
+		})
+	}
+	body, err := c.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 2+binary.MaxVarintLen64+len(cmd)+len(body))
+	b = append(b, version, c.Id())
+	b = binary.AppendUvarint(b, uint64(len(cmd)))
+	b = append(b, cmd...)
+	return append(b, body...), nil
+}
+
+// decodeRequest - version, codec id, cmd and the encoded request of a frame of version >= 1
+func decodeRequest(b []byte) (byte, byte, string, []byte, error) {
+	if len(b) < 2 {
+		return 0, 0, "", nil, errors.New("short frame")
+	}
+	n, m := binary.Uvarint(b[2:])
+	if m <= 0 || n > uint64(len(b)-2-m) {
+		return 0, 0, "", nil, errors.New("malformed frame")
+	}
+	rest := b[2+m:]
+	return b[0], b[1], string(rest[:n]), rest[n:], nil
+}
+
+// requestCmd - cmd of a request frame of any version, empty if it is malformed
+func requestCmd(b []byte) string {
+	if len(b) > 0 && b[0] == '{' {
+		msg := message{}
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return ""
+		}
+		return msg.Cmd
+	}
+	_, _, cmd, _, err := decodeRequest(b)
+	if err != nil {
+		return ""
+	}
+	return cmd
+}
+
+// peer - protocol negotiated with a peer
+type peer struct {
+	mu         sync.Mutex
+	negotiated bool
+	version    byte
+	codec      Codec
+	preferred  Codec
+	until      time.Time // zero while the preferred protocol is used
+}
+
+func newPeer(c Codec) *peer {
+	return &peer{
+		mu:         sync.Mutex{},
+		negotiated: false,
+		version:    PROTOCOL_VERSION,
+		codec:      c,
+		preferred:  c,
+		until:      time.Time{},
+	}
+}
+
+var peers sync.Map // address -> *peer
+
+func getPeer(addr string) *peer {
+	p, _ := peers.LoadOrStore(addr, newPeer(getCodec()))
+	return p.(*peer)
+}
+
+// protocol - protocol negotiated with the peer, greet it over roundTrip first unless it has been negotiated
+// a request is only sent once the peer has told which protocols it accepts
+func (p *peer) protocol(ctx context.Context, roundTrip RoundTripFunc) (byte, Codec, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.negotiated && (p.until.IsZero() || time.Now().Before(p.until)) {
+		return p.version, p.codec, nil
+	}
+	version, c, err := hello(ctx, roundTrip, p.preferred)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.set(version, c)
+	return version, c, nil
+}
+
+func (p *peer) downgrade(version byte, c Codec) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(version, c)
+}
+
+func (p *peer) set(version byte, c Codec) {
+	p.negotiated, p.version, p.codec, p.until = true, version, c, time.Time{}
+	if version != PROTOCOL_VERSION || c != p.preferred {
+		p.until = time.Now().Add(NEGOTIATE_INTERVAL)
+	}
+}
+
+// reset - greet the peer again before the next request, it may have been restarted with another protocol
+func (p *peer) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.negotiated = false
+}
+
+func helloFrame() []byte {
+	return []byte{PROTOCOL_VERSION, CODEC_REJECTED, 0}
+}
+
+// hello - newest protocol both sides accept from the answer of the peer to a hello frame
+// the peer predates protocol versions only if it closes the connection on two hellos in a row,
+// a hello has no effect so a peer that has failed in between is greeted again rather than downgraded
+func hello(ctx context.Context, roundTrip RoundTripFunc, c Codec) (byte, Codec, error) {
+	var b []byte
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		b, err = roundTrip(ctx, helloFrame())
+		if !isClosed(err) {
+			break
+		}
+	}
+	if isClosed(err) {
+		return 0, JSON_CODEC, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 2 || b[1] != CODEC_REJECTED {
+		return 0, nil, errors.New("malformed hello")
+	}
+	return negotiate(PROTOCOL_VERSION, c, b)
+}
+
+// negotiate - newest protocol both sides accept from a rejected frame
+func negotiate(version byte, c Codec, rejected []byte) (byte, Codec, error) {
+	version = min(version, rejected[0])
+	if version == 0 {
+		return 0, JSON_CODEC, nil
+	}
+	accepted := rejected[2:]
+	if slices.Contains(accepted, c.Id()) {
+		return version, c, nil
+	}
+	for _, known := range CODECS {
+		if slices.Contains(accepted, known.Id()) {
+			return version, known, nil
+		}
+	}
+	return 0, nil, ErrUnsupported
+}
+
+// isClosed - the connection has been closed before a response
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RoundTripFunc - send a frame and receive the response frame
+type RoundTripFunc func(ctx context.Context, b []byte) ([]byte, error)
+
+// NewTransport - TransportFunc that prefers c over roundTrip, such as the Handle of a local Dispatcher
+func NewTransport(roundTrip RoundTripFunc, c Codec) TransportFunc {
+	return newTransport(roundTrip, newPeer(c))
+}
+
+// newTransport - TransportFunc over roundTrip that negotiates the protocol with p
+func newTransport(roundTrip RoundTripFunc, p *peer) TransportFunc {
+	return func(ctx context.Context, cmd string, req any, res any) error {
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		version, c, err := p.protocol(ctx, roundTrip)
+		if err != nil {
+			return err
+		}
+		for attempt := 0; ; attempt++ {
+			b, err := encodeRequest(version, c, cmd, req)
+			if err != nil {
+				return err
+			}
+			b, err = roundTrip(ctx, b)
+			if err != nil {
+				if isClosed(err) {
+					p.reset() // the request may have been handled, it is not sent again
+				}
+				return err
+			}
+			if version == 0 {
+				return json.Unmarshal(b, res)
+			}
+			if len(b) < 2 {
+				return errors.New("short frame")
+			}
+			if b[1] == CODEC_REJECTED {
+				// the request has not been handled, the peer has been restarted with other protocols since the hello
+				if attempt > 0 {
+					return ErrUnsupported
+				}
+				version, c, err = negotiate(version, c, b)
+				if err != nil {
+					return err
+				}
+				p.downgrade(version, c)
+				continue
+			}
+			if b[1] != c.Id() {
+				return fmt.Errorf("response in codec %d, requested %d", b[1], c.Id())
+			}
+			return c.Unmarshal(b[2:], res)
+		}
+	}
+}
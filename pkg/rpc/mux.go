@@ -0,0 +1,359 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// a multiplexed connection starts with MUX_HELLO from the client, echoed by the server
+// then every message is a request id, a status and the frame, responses carry the id of their request
+const (
+	MUX_HELLO          = "\xffmux/1"
+	MUX_OK        byte = 0
+	MUX_ERROR     byte = 1 // the frame is the error message of the handler
+	MUX_ID_LENGTH      = 8
+	// RECONNECT_TIME - backoff between dials to a peer that cannot be reached
+	RECONNECT_MIN_TIME = 10 * time.Millisecond
+	RECONNECT_MAX_TIME = 1000 * time.Millisecond
+)
+
+var (
+	errConnLost     = errors.New("connection lost")
+	errReconnecting = errors.New("reconnecting")
+	errNoMux        = errors.New("peer does not multiplex")
+)
+
+type muxResult struct {
+	b   []byte
+	err error
+}
+
+type muxRequest struct {
+	env Envelope
+	ch  chan muxResult
+}
+
+// muxConn - connection shared by concurrent requests, responses are matched to requests by id
+// the id of a request is its sequence number
+type muxConn struct {
+	conn     net.Conn
+	key      IO
+	from     string
+	addr     string
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	pending  map[uint64]muxRequest
+	lost     bool
+	lastRead time.Time // a request without a response since then is a sign of a dead peer
+}
+
+func appendMuxHeader(b []byte, id uint64, status byte) []byte {
+	return append(binary.BigEndian.AppendUint64(b, id), status)
+}
+
+func parseMuxFrame(b []byte) (uint64, byte, []byte, bool) {
+	if len(b) < MUX_ID_LENGTH+1 {
+		return 0, 0, nil, false
+	}
+	return binary.BigEndian.Uint64(b), b[MUX_ID_LENGTH], b[MUX_ID_LENGTH+1:], true
+}
+
+// dialMux - errNoMux if the peer has closed the connection or answered anything but MUX_HELLO
+func dialMux(ctx context.Context, dial dialFunc, from string, addr string, key IO) (*muxConn, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnDone(ctx, conn)
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	hello := Envelope{
+		From:     from,
+		To:       addr,
+		Cmd:      "",
+		Response: false,
+		Seq:      nextSeq(),
+	}
+	if err == nil {
+		err = key.Write(hello, []byte(MUX_HELLO), conn)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	env, b, err := key.Read(conn)
+	if !stop() {
+		return nil, ctx.Err() // conn has been closed
+	}
+	if err != nil || string(b) != MUX_HELLO {
+		_ = conn.Close()
+		if err != nil && !isClosed(err) {
+			return nil, err
+		}
+		return nil, errNoMux
+	}
+	if err = checkResponse(hello, env); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c := &muxConn{
+		conn:     conn,
+		key:      key,
+		from:     from,
+		addr:     addr,
+		writeMu:  sync.Mutex{},
+		mu:       sync.Mutex{},
+		pending:  make(map[uint64]muxRequest),
+		lost:     false,
+		lastRead: time.Now(),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *muxConn) readLoop() {
+	for {
+		env, b, err := c.key.Read(c.conn)
+		if err != nil {
+			c.fail()
+			return
+		}
+		id, status, frame, ok := parseMuxFrame(b)
+		if !ok {
+			c.fail()
+			return
+		}
+		c.mu.Lock()
+		req, ok := c.pending[id]
+		delete(c.pending, id)
+		c.lastRead = time.Now()
+		c.mu.Unlock()
+		if !ok {
+			continue // the request has timed out
+		}
+		if err = checkResponse(req.env, env); err != nil {
+			fmt.Println(err)
+			req.ch <- muxResult{
+				b:   nil,
+				err: err,
+			}
+			c.fail()
+			return
+		}
+		ch := req.ch
+		if status == MUX_ERROR {
+			ch <- muxResult{
+				b:   nil,
+				err: errors.New(string(frame)),
+			}
+			continue
+		}
+		ch <- muxResult{
+			b:   frame,
+			err: nil,
+		}
+	}
+}
+
+// fail - close the connection and fail every pending request
+func (c *muxConn) fail() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lost {
+		return
+	}
+	c.lost = true
+	_ = c.conn.Close()
+	for id, req := range c.pending {
+		req.ch <- muxResult{
+			b:   nil,
+			err: errConnLost,
+		}
+		delete(c.pending, id)
+	}
+}
+
+func (c *muxConn) isLost() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lost
+}
+
+// roundTrip - the connection is considered lost if nothing has arrived for TCP_TIMEOUT while b is in flight
+func (c *muxConn) roundTrip(ctx context.Context, b []byte) ([]byte, error) {
+	ch := make(chan muxResult, 1)
+	id := nextSeq()
+	env := Envelope{
+		From:     c.from,
+		To:       c.addr,
+		Cmd:      requestCmd(b),
+		Response: false,
+		Seq:      id,
+	}
+	c.mu.Lock()
+	if c.lost {
+		c.mu.Unlock()
+		return nil, errConnLost
+	}
+	c.pending[id] = muxRequest{
+		env: env,
+		ch:  ch,
+	}
+	sent := time.Now()
+	c.mu.Unlock()
+
+	frame := append(appendMuxHeader(make([]byte, 0, MUX_ID_LENGTH+1+len(b)), id, MUX_OK), b...)
+	c.writeMu.Lock()
+	err := c.conn.SetWriteDeadline(time.Now().Add(TCP_TIMEOUT))
+	if err == nil {
+		err = c.key.Write(env, frame, c.conn)
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail()
+		return nil, errConnLost
+	}
+
+	select {
+	case r := <-ch:
+		return r.b, r.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		silent := c.lastRead.Before(sent) && time.Since(c.lastRead) >= TCP_TIMEOUT
+		c.mu.Unlock()
+		if silent {
+			c.fail() // the peer is gone
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// muxPeer - multiplexed connection to addr, dialed again with backoff once it is lost
+type muxPeer struct {
+	from        string
+	addr        string
+	key         IO
+	dial        dialFunc
+	mu          sync.Mutex
+	conn        *muxConn // nil until dialed
+	wait        time.Duration
+	retryAt     time.Time // no dial before this
+	legacyUntil time.Time // the peer does not multiplex, dial for every request until then
+}
+
+var muxPeers sync.Map // name -> *muxPeer
+
+// getMuxPeer - peer at addr for from, named by the scheme and the addresses, key and dial are those of the first call for name
+func getMuxPeer(name string, from string, addr string, key IO, dial dialFunc) *muxPeer {
+	if p, ok := muxPeers.Load(name); ok {
+		return p.(*muxPeer)
+	}
+	p, _ := muxPeers.LoadOrStore(name, &muxPeer{
+		from:        from,
+		addr:        addr,
+		key:         key,
+		dial:        dial,
+		mu:          sync.Mutex{},
+		conn:        nil,
+		wait:        RECONNECT_MIN_TIME,
+		retryAt:     time.Time{},
+		legacyUntil: time.Time{},
+	})
+	return p.(*muxPeer)
+}
+
+// get - connection to the peer, nil if it does not multiplex
+func (p *muxPeer) get(ctx context.Context) (*muxConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Before(p.legacyUntil) {
+		return nil, nil
+	}
+	if p.conn != nil && !p.conn.isLost() {
+		return p.conn, nil
+	}
+	if now.Before(p.retryAt) {
+		return nil, errReconnecting
+	}
+	c, err := dialMux(ctx, p.dial, p.from, p.addr, p.key)
+	if errors.Is(err, errNoMux) {
+		p.legacyUntil = now.Add(NEGOTIATE_INTERVAL)
+		return nil, nil
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, err // the caller has given up, not the peer
+	}
+	if err != nil {
+		p.retryAt = now.Add(time.Duration(rand.Int63n(int64(p.wait))))
+		p.wait = min(2*p.wait, RECONNECT_MAX_TIME)
+		return nil, err
+	}
+	p.conn, p.wait, p.retryAt = c, RECONNECT_MIN_TIME, time.Time{}
+	return c, nil
+}
+
+func (p *muxPeer) roundTrip(ctx context.Context, b []byte) ([]byte, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return dialRoundTrip(ctx, p.dial, p.from, p.addr, p.key, b)
+	}
+	return c.roundTrip(ctx, b)
+}
+
+// serveMux - handle the requests of a multiplexed connection concurrently
+func (s *tcpServer) serveMux(conn net.Conn) {
+	key := s.key
+	writeMu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		env, b, err := key.Read(conn)
+		if err != nil {
+			return
+		}
+		id, _, frame, ok := parseMuxFrame(b)
+		if !ok || !s.authorized(conn) {
+			return
+		}
+		if err = s.replay.checkRequest(env, s.addr, requestCmd(frame)); err == nil && !env.legacy && env.Seq != id {
+			err = fmt.Errorf("%w: request %d in frame %d", errMisdirected, env.Seq, id)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status := MUX_OK
+			out, err := s.dispatcher.Handle(frame)
+			if err != nil {
+				status, out = MUX_ERROR, []byte(err.Error())
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			err = conn.SetWriteDeadline(time.Now().Add(TCP_TIMEOUT))
+			if err == nil {
+				err = key.Write(env.response(), append(appendMuxHeader(make([]byte, 0, MUX_ID_LENGTH+1+len(out)), id, status), out...), conn)
+			}
+			if err != nil {
+				_ = conn.Close()
+			}
+		}()
+	}
+}
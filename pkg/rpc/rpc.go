@@ -1,9 +1,11 @@
 package rpc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"slices"
 )
 
 type Dispatcher interface {
@@ -11,17 +13,28 @@ type Dispatcher interface {
 	Handle(input []byte) (output []byte, err error)
 }
 
-func NewDispatcher() Dispatcher {
-	return dispatcher(make(map[string]handler))
+// NewDispatcher - dispatcher that accepts messages in codecs, CODECS if none is given
+func NewDispatcher(codecs ...Codec) Dispatcher {
+	if len(codecs) == 0 {
+		codecs = CODECS
+	}
+	return &dispatcher{
+		handlers: make(map[string]handler),
+		codecs:   codecs,
+	}
 }
 
 type handler struct {
 	handlerFunc reflect.Value
 	argType     reflect.Type
 }
-type dispatcher map[string]handler
 
-func (d dispatcher) Register(cmd string, h any) Dispatcher {
+type dispatcher struct {
+	handlers map[string]handler
+	codecs   []Codec
+}
+
+func (d *dispatcher) Register(cmd string, h any) Dispatcher {
 	handlerFunc := reflect.ValueOf(h)
 	handlerFuncType := handlerFunc.Type()
 	if handlerFuncType.Kind() != reflect.Func || handlerFuncType.NumIn() != 1 || handlerFuncType.NumOut() != 1 {
@@ -32,70 +45,89 @@ func (d dispatcher) Register(cmd string, h any) Dispatcher {
 	if argType.Kind() != reflect.Ptr || retType.Kind() != reflect.Ptr {
 		panic("handler arguments and return type must be pointers")
 	}
-	d[cmd] = handler{
+	d.handlers[cmd] = handler{
 		handlerFunc: handlerFunc,
 		argType:     argType,
 	}
 	return d
 }
 
+// message - JSON message of version 0
 type message struct {
 	Cmd  string `json:"cmd"`
 	Body []byte `json:"body"`
 }
 
-func (d dispatcher) Handle(input []byte) (output []byte, err error) {
-	msg := message{}
-	if err = json.Unmarshal(input, &msg); err != nil {
-		return nil, err
-	}
-
-	h, ok := d[msg.Cmd]
+func (d *dispatcher) call(cmd string, body []byte, c Codec) (any, error) {
+	h, ok := d.handlers[cmd]
 	if !ok {
 		return nil, fmt.Errorf("command not found")
 	}
-
 	argPtr := reflect.New(h.argType.Elem()).Interface()
-	if err = json.Unmarshal(msg.Body, argPtr); err != nil {
+	if err := c.Unmarshal(body, argPtr); err != nil {
 		return nil, err
 	}
+	return h.handlerFunc.Call([]reflect.Value{reflect.ValueOf(argPtr)})[0].Interface(), nil
+}
 
-	out := h.handlerFunc.Call([]reflect.Value{reflect.ValueOf(argPtr)})[0].Interface()
-
-	output, err = json.Marshal(out)
-	if err != nil {
-		return nil, err
+// rejected - frame with the protocol version and the codecs of this node, the answer to a hello
+func (d *dispatcher) rejected() []byte {
+	b := []byte{PROTOCOL_VERSION, CODEC_REJECTED}
+	for _, c := range d.codecs {
+		b = append(b, c.Id())
 	}
-	return output, nil
+	return b
 }
 
-type TransportFunc func([]byte) ([]byte, error)
-
-func zeroPtr[T any]() *T {
-	var v T
-	return &v
-}
+func (d *dispatcher) Handle(input []byte) (output []byte, err error) {
+	if len(input) > 0 && input[0] == '{' {
+		msg := message{}
+		if err = json.Unmarshal(input, &msg); err != nil {
+			return nil, err
+		}
+		out, err := d.call(msg.Cmd, msg.Body, JSON_CODEC)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(out)
+	}
 
-func RPC[Req any, Res any](transport TransportFunc, cmd string, req *Req) (res *Res, err error) {
-	body, err := json.Marshal(req)
+	version, codecId, cmd, body, err := decodeRequest(input)
 	if err != nil {
 		return nil, err
 	}
-	msg := message{
-		Cmd:  cmd,
-		Body: body,
+	if codecId == CODEC_REJECTED {
+		return d.rejected(), nil // hello
+	}
+	i := slices.IndexFunc(d.codecs, func(c Codec) bool {
+		return c.Id() == codecId
+	})
+	if version == 0 || version > PROTOCOL_VERSION || i < 0 {
+		return d.rejected(), nil
 	}
-	b, err := json.Marshal(msg)
+	c := d.codecs[i]
+	out, err := d.call(cmd, body, c)
 	if err != nil {
 		return nil, err
 	}
-	b, err = transport(b)
+	b, err := c.Marshal(out)
 	if err != nil {
 		return nil, err
 	}
+	return append([]byte{version, c.Id()}, b...), nil
+}
+
+// TransportFunc - send cmd with req to a peer and decode its response into res, the call is abandoned once ctx is done
+type TransportFunc func(ctx context.Context, cmd string, req any, res any) error
+
+func zeroPtr[T any]() *T {
+	var v T
+	return &v
+}
 
+func RPC[Req any, Res any](ctx context.Context, transport TransportFunc, cmd string, req *Req) (res *Res, err error) {
 	res = zeroPtr[Res]()
-	if err = json.Unmarshal(b, res); err != nil {
+	if err = transport(ctx, cmd, req, res); err != nil {
 		return nil, err
 	}
 	return res, nil
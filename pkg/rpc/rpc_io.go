@@ -3,19 +3,80 @@ package rpc
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"dist_kvstore/pkg/crypt"
 )
 
+// a message is the length of the payload then the payload
+// payload - header then the frame sealed with the header as additional data
+// header  - AUTH_MAGIC and the envelope for the key of id 0, AUTH_KEYRING_MAGIC, uvarint key id and the envelope otherwise
+// a payload without header is a frame sealed alone, sent by nodes before envelopes
+const (
+	AUTH_MAGIC         = "\xfeauth/1"
+	AUTH_KEYRING_MAGIC = "\xfeauth/2"
+	// RPC_AUTH_ENV - "legacy" to accept frames without envelopes and send them to peers that have not sent envelopes,
+	// while nodes before envelopes remain
+	RPC_AUTH_ENV = "DIST_KVSTORE_RPC_AUTH"
+	// REPLAY_WINDOW - requests whose sequence number is further than this from the clock of the receiver are rejected
+	// requests within it are remembered to reject their replays, clocks of nodes must be closer than this
+	REPLAY_WINDOW = 30 * time.Second
+)
+
+var (
+	errUnauthenticated = errors.New("message without envelope")
+	errMisdirected     = errors.New("misdirected message")
+	errReplayed        = errors.New("replayed message")
+	errStale           = errors.New("message outside of the replay window")
+)
+
+// Envelope - context of a frame, sent in the clear and authenticated together with it
+type Envelope struct {
+	From     string // address of the sender
+	To       string // address of the receiver
+	Cmd      string // empty for MUX_HELLO
+	Response bool
+	Seq      uint64 // of the request, a response carries that of its request
+	legacy   bool   // the frame has been sent without envelope
+}
+
 type IO interface {
-	Write(b []byte, writer io.Writer) (err error)
-	Read(reader io.Reader) (b []byte, err error)
+	Write(env Envelope, b []byte, writer io.Writer) (err error)
+	Read(reader io.Reader) (env Envelope, b []byte, err error)
+}
+
+// NewCryptIO - IO sealing every frame with its envelope, see RPC_AUTH_ENV for nodes before envelopes
+func NewCryptIO(c crypt.Crypt) IO {
+	return NewKeyringIO(crypt.StaticKeyring(c))
 }
 
-func NewCryptIO(crypt crypt.Crypt) IO {
+// NewKeyringIO - IO sealing frames by the current key of keyring, the id of the key is in the header
+func NewKeyringIO(keyring *crypt.Keyring) IO {
 	return &cryptIO{
-		crypt: crypt,
+		keyring: keyring,
+		legacy:  os.Getenv(RPC_AUTH_ENV) == "legacy",
+	}
+}
+
+var enveloped sync.Map // addresses of the peers that have sent envelopes -> struct{}
+
+var lastSeq atomic.Uint64
+
+// nextSeq - sequence number of a request, the time in ns unless requests have been faster
+// it increases across restarts as long as the clock does
+func nextSeq() uint64 {
+	for {
+		last := lastSeq.Load()
+		seq := max(last+1, uint64(time.Now().UnixNano()))
+		if lastSeq.CompareAndSwap(last, seq) {
+			return seq
+		}
 	}
 }
 
@@ -32,46 +93,219 @@ func writeExact(writer io.Writer, b []byte) error {
 
 func readExact(reader io.Reader, n int) ([]byte, error) {
 	b := make([]byte, n)
-	m, err := reader.Read(b)
+	_, err := io.ReadFull(reader, b)
 	if err != nil {
 		return nil, err
 	}
-	if m != n {
-		return nil, errors.New("cannot read buffer")
-	}
 	return b, nil
 }
 
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	n, m := binary.Uvarint(b)
+	if m <= 0 || n > uint64(len(b)-m) {
+		return "", nil, false
+	}
+	return string(b[m : m+int(n)]), b[m+int(n):], true
+}
+
+func appendHeader(b []byte, keyId uint32, env Envelope) []byte {
+	if keyId == 0 {
+		b = append(b, AUTH_MAGIC...)
+	} else {
+		b = append(b, AUTH_KEYRING_MAGIC...)
+		b = binary.AppendUvarint(b, uint64(keyId))
+	}
+	b = appendString(b, env.From)
+	b = appendString(b, env.To)
+	b = appendString(b, env.Cmd)
+	response := byte(0)
+	if env.Response {
+		response = 1
+	}
+	b = append(b, response)
+	return binary.BigEndian.AppendUint64(b, env.Seq)
+}
+
+// parseHeader - key id and envelope of a payload with a header and the length of the header
+// ok is false if the payload has no header
+func parseHeader(payload []byte) (keyId uint32, env Envelope, n int, ok bool, err error) {
+	if len(payload) < len(AUTH_MAGIC) {
+		return 0, Envelope{}, 0, false, nil
+	}
+	rest := payload[len(AUTH_MAGIC):]
+	switch string(payload[:len(AUTH_MAGIC)]) {
+	case AUTH_MAGIC:
+	case AUTH_KEYRING_MAGIC:
+		id, m := binary.Uvarint(rest)
+		if m <= 0 || id > math.MaxUint32 {
+			return 0, Envelope{}, 0, true, errors.New("malformed key id")
+		}
+		keyId, rest = uint32(id), rest[m:]
+	default:
+		return 0, Envelope{}, 0, false, nil
+	}
+	ok1, ok2, ok3 := false, false, false
+	env.From, rest, ok1 = readString(rest)
+	if ok1 {
+		env.To, rest, ok2 = readString(rest)
+	}
+	if ok2 {
+		env.Cmd, rest, ok3 = readString(rest)
+	}
+	if !ok3 || len(rest) < 9 {
+		return 0, Envelope{}, 0, true, errors.New("malformed envelope")
+	}
+	env.Response = rest[0] == 1
+	env.Seq = binary.BigEndian.Uint64(rest[1:9])
+	return keyId, env, len(payload) - len(rest) + 9, true, nil
+}
+
 type cryptIO struct {
-	crypt crypt.Crypt
+	keyring *crypt.Keyring
+	legacy  bool
 }
 
-func (c *cryptIO) Write(plaintext []byte, writer io.Writer) (err error) {
-	ciphertext, err := c.crypt.Encrypt(plaintext)
+func (c *cryptIO) Write(env Envelope, plaintext []byte, writer io.Writer) (err error) {
+	// responses are sent as their request
+	legacy := env.legacy
+	if c.legacy && !env.Response {
+		_, ok := enveloped.Load(env.To)
+		legacy = !ok
+	}
+	keyId, key := c.keyring.Current()
+	ad := []byte(nil)
+	if !legacy {
+		ad = appendHeader(nil, keyId, env)
+	}
+	ciphertext, err := key.Seal(plaintext, ad)
 	if err != nil {
 		return err
 	}
-	n := uint64(len(ciphertext))
-	b := make([]byte, 8, 8+len(ciphertext))
+	n := uint64(len(ad) + len(ciphertext))
+	b := make([]byte, 8, 8+n)
 	binary.LittleEndian.PutUint64(b, n)
+	b = append(b, ad...)
 	b = append(b, ciphertext...)
 
 	return writeExact(writer, b)
 }
 
-func (c *cryptIO) Read(reader io.Reader) (plaintext []byte, err error) {
+func (c *cryptIO) Read(reader io.Reader) (env Envelope, plaintext []byte, err error) {
 	b, err := readExact(reader, 8)
 	if err != nil {
-		return nil, err
+		return Envelope{}, nil, err
 	}
 	n := int(binary.LittleEndian.Uint64(b))
-	ciphertext, err := readExact(reader, n)
+	payload, err := readExact(reader, n)
 	if err != nil {
-		return nil, err
+		return Envelope{}, nil, err
 	}
-	plaintext, err = c.crypt.Decrypt(ciphertext)
+	keyId, env, m, ok, err := parseHeader(payload)
 	if err != nil {
-		return nil, err
+		return Envelope{}, nil, err
+	}
+	if !ok {
+		if !c.legacy {
+			return Envelope{}, nil, errUnauthenticated
+		}
+		_, key := c.keyring.Current()
+		plaintext, err = key.Decrypt(payload)
+		if err != nil {
+			return Envelope{}, nil, err
+		}
+		return Envelope{legacy: true}, plaintext, nil
+	}
+	key, ok := c.keyring.Get(keyId)
+	if !ok {
+		return Envelope{}, nil, fmt.Errorf("unknown key %d from %s", keyId, env.From)
+	}
+	plaintext, err = key.Open(payload[m:], payload[:m])
+	if err != nil {
+		return Envelope{}, nil, err
+	}
+	if c.legacy && !env.Response {
+		enveloped.Store(env.From, struct{}{})
+	}
+	return env, plaintext, nil
+}
+
+// response - envelope of the response to req
+func (req Envelope) response() Envelope {
+	return Envelope{
+		From:     req.To,
+		To:       req.From,
+		Cmd:      req.Cmd,
+		Response: true,
+		Seq:      req.Seq,
+		legacy:   req.legacy,
+	}
+}
+
+// checkResponse - res must be the response to req
+func checkResponse(req Envelope, res Envelope) error {
+	if res.legacy {
+		return nil
+	}
+	if res != req.response() {
+		return fmt.Errorf("%w: response to %s %d from %s", errMisdirected, res.Cmd, res.Seq, res.From)
+	}
+	return nil
+}
+
+type replayKey struct {
+	from string
+	seq  uint64
+}
+
+// replayCache - requests received within REPLAY_WINDOW
+type replayCache struct {
+	mu    sync.Mutex
+	seen  map[replayKey]struct{}
+	order []replayKey // in the order received, about that of sequence numbers
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		mu:    sync.Mutex{},
+		seen:  make(map[replayKey]struct{}),
+		order: nil,
+	}
+}
+
+// checkRequest - env must be a request to addr for cmd, received for the first time within REPLAY_WINDOW
+func (c *replayCache) checkRequest(env Envelope, addr string, cmd string) error {
+	if env.legacy {
+		return nil
+	}
+	if env.Response || env.To != addr || env.Cmd != cmd {
+		return fmt.Errorf("%w: %s to %s from %s", errMisdirected, env.Cmd, env.To, env.From)
+	}
+	now := time.Now()
+	sent := time.Unix(0, int64(env.Seq))
+	if sent.Before(now.Add(-REPLAY_WINDOW)) || sent.After(now.Add(REPLAY_WINDOW)) {
+		return fmt.Errorf("%w: %s %d from %s", errStale, env.Cmd, env.Seq, env.From)
 	}
-	return plaintext, nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cutoff := uint64(now.Add(-REPLAY_WINDOW).UnixNano())
+	i := 0
+	for i < len(c.order) && c.order[i].seq < cutoff {
+		delete(c.seen, c.order[i])
+		i++
+	}
+	c.order = c.order[i:]
+	k := replayKey{
+		from: env.From,
+		seq:  env.Seq,
+	}
+	if _, ok := c.seen[k]; ok {
+		return fmt.Errorf("%w: %s %d from %s", errReplayed, env.Cmd, env.Seq, env.From)
+	}
+	c.seen[k] = struct{}{}
+	c.order = append(c.order, k)
+	return nil
 }
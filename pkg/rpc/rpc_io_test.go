@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dist_kvstore/pkg/crypt"
+)
+
+// testKeyring - keyring of configs loaded from a file
+func testKeyring(t *testing.T, configs ...crypt.KeyConfig) *crypt.Keyring {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	b, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := crypt.LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyringIO(t *testing.T) {
+	old := crypt.KeyConfig{Id: 1, Key: "old", DecryptOnly: false}
+	rotated := crypt.KeyConfig{Id: 2, Key: "new", DecryptOnly: false}
+	env := Envelope{
+		From:     "localhost:3000",
+		To:       "localhost:3001",
+		Cmd:      "cmd",
+		Response: false,
+		Seq:      1,
+		legacy:   false,
+	}
+	for _, c := range []struct {
+		name     string
+		sender   *crypt.Keyring
+		receiver *crypt.Keyring
+		err      string
+	}{
+		{"newest key", testKeyring(t, old, rotated), testKeyring(t, old, rotated), ""},
+		{"older key", testKeyring(t, old), testKeyring(t, old, rotated), ""},
+		{"unknown key", testKeyring(t, old, rotated), testKeyring(t, old), "unknown key 2"},
+	} {
+		buf := bytes.Buffer{}
+		if err := NewKeyringIO(c.sender).Write(env, []byte("hello"), &buf); err != nil {
+			t.Fatal(err)
+		}
+		got, plaintext, err := NewKeyringIO(c.receiver).Read(&buf)
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s: read with %v, want %s", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil || got != env || !bytes.Equal(plaintext, []byte("hello")) {
+			t.Fatalf("%s: read %+v %q %v", c.name, got, plaintext, err)
+		}
+	}
+
+	// a frame sealed for another receiver fails to open
+	buf := bytes.Buffer{}
+	k := testKeyring(t, old)
+	if err := NewKeyringIO(k).Write(env, []byte("hello"), &buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	i := bytes.Index(b, []byte("localhost:3001"))
+	b[i+len("localhost:300")] = '2'
+	if _, _, err := NewKeyringIO(k).Read(bytes.NewReader(b)); err == nil {
+		t.Fatal("frame with a forged receiver opened")
+	}
+}
@@ -1,116 +1,337 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"dist_kvstore/pkg/crypt"
 )
 
 const (
+	// TCP_TIMEOUT - deadline of calls whose context has none
 	TCP_TIMEOUT = 10 * time.Second
 	RPC_KEY_ENV = "DIST_KVSTORE_RPC_KEY"
+	// RPC_KEYRING_ENV - path of a keyring, see crypt.LoadKeyring, used instead of RPC_KEY_ENV if set
+	RPC_KEYRING_ENV = "DIST_KVSTORE_RPC_KEYRING"
+	// RPC_INSECURE_ENV - "true" to allow messages in plaintext if neither TLS nor a key is configured
+	RPC_INSECURE_ENV = "DIST_KVSTORE_RPC_INSECURE"
 )
 
+// ErrInsecure - neither TLS nor a key is configured and plaintext is not allowed
+var ErrInsecure = errors.New("rpc is not encrypted, configure TLS or " + RPC_KEY_ENV + " or " + RPC_KEYRING_ENV + " or set " + RPC_INSECURE_ENV + "=true")
+
 type TCPServer interface {
 	ListenAndServe(dispatcher Dispatcher) error
 	Close() error
 }
 
-func getKey() IO {
-	keyStr := os.Getenv(RPC_KEY_ENV)
-	key := NewCryptIO(crypt.NewCrypt(keyStr))
-	return key
-}
+var (
+	keyringsMu sync.Mutex
+	keyrings   = map[string]*crypt.Keyring{} // path -> keyring
+)
 
-func TCPTransport(addr string) TransportFunc {
-	key := getKey()
+// getKeyring - keyring at path, loaded once for every path
+func getKeyring(path string) (*crypt.Keyring, error) {
+	keyringsMu.Lock()
+	defer keyringsMu.Unlock()
+	if k, ok := keyrings[path]; ok {
+		return k, nil
+	}
+	k, err := crypt.LoadKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+	keyrings[path] = k
+	return k, nil
+}
 
-	return func(b []byte) ([]byte, error) {
+// ReloadKeyrings - load the files of the keyrings in use again, the keys of a keyring that fails to load are kept
+func ReloadKeyrings() error {
+	keyringsMu.Lock()
+	defer keyringsMu.Unlock()
+	var errs []error
+	for _, k := range keyrings {
+		errs = append(errs, k.Reload())
+	}
+	return errors.Join(errs...)
+}
 
-		conn, err := net.Dial("tcp", addr)
+// getKey - ErrInsecure if no key is configured and plaintext is not allowed
+func getKey() (IO, error) {
+	if path := os.Getenv(RPC_KEYRING_ENV); len(path) > 0 {
+		keyring, err := getKeyring(path)
 		if err != nil {
-			fmt.Println(err)
 			return nil, err
 		}
-		defer conn.Close()
+		return NewKeyringIO(keyring), nil
+	}
+	keyStr := os.Getenv(RPC_KEY_ENV)
+	if len(keyStr) == 0 && os.Getenv(RPC_INSECURE_ENV) != "true" {
+		return nil, ErrInsecure
+	}
+	key := NewCryptIO(crypt.NewCrypt(keyStr))
+	return key, nil
+}
 
-		err = conn.SetDeadline(time.Now().Add(TCP_TIMEOUT))
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
-		}
+// dialFunc - open a connection to addr, abandoned once ctx is done
+type dialFunc func(ctx context.Context, addr string) (net.Conn, error)
 
-		err = key.Write(b, conn)
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
-		}
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
 
-		b, err = key.Read(conn)
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+// TCPTransport - messages from the node at from to addr share one multiplexed connection, the protocol is negotiated once for every addr
+// messages are encrypted by the keyring in RPC_KEYRING_ENV or the key in RPC_KEY_ENV
+func TCPTransport(from string, addr string) TransportFunc {
+	key, err := getKey()
+	if err != nil {
+		return func(ctx context.Context, cmd string, req any, res any) error {
+			return err
 		}
+	}
+	return newTransport(getMuxPeer(from+"->tcp://"+addr, from, addr, key, dialTCP).roundTrip, getPeer(addr))
+}
+
+// withTimeout - ctx with a deadline of TCP_TIMEOUT unless it has one
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, TCP_TIMEOUT)
+}
+
+// closeOnDone - close conn once ctx is done to interrupt reads and writes, stop before conn is used otherwise
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+}
+
+// dialRoundTrip - one connection for a single message, for peers that do not multiplex
+func dialRoundTrip(ctx context.Context, dial dialFunc, from string, addr string, key IO, b []byte) ([]byte, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
 
-		return b, nil
+	req := Envelope{
+		From:     from,
+		To:       addr,
+		Cmd:      requestCmd(b),
+		Response: false,
+		Seq:      nextSeq(),
+	}
+	err = key.Write(req, b, conn)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	env, b, err := key.Read(conn)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
 	}
+	if err = checkResponse(req, env); err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return b, nil
 }
 
 type tcpServer struct {
+	addr       string // requests must be addressed to it
 	dispatcher Dispatcher
 	listener   net.Listener
 	key        IO
+	replay     *replayCache
+	authorize  func(conn net.Conn) error // nil if every connection is served, otherwise checked before every request
+	mu         sync.Mutex
+	conns      map[net.Conn]struct{} // open connections, closed with the server
 }
 
+// NewTCPServer - server of messages encrypted by the keyring in RPC_KEYRING_ENV or the key in RPC_KEY_ENV, ErrInsecure if there is none
 func NewTCPServer(bindAddr string) (TCPServer, error) {
+	key, err := getKey()
+	if err != nil {
+		return nil, err
+	}
 	listener, err := net.Listen("tcp", bindAddr)
 	if err != nil {
 		return nil, err
 	}
 	return &tcpServer{
+		addr:       bindAddr,
 		dispatcher: nil,
 		listener:   listener,
-		key:        getKey(),
+		key:        key,
+		replay:     newReplayCache(),
+		authorize:  nil,
+		mu:         sync.Mutex{},
+		conns:      make(map[net.Conn]struct{}),
 	}, nil
 }
 
 func (s *tcpServer) Close() error {
-	return s.listener.Close()
+	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+	return err
+}
+
+// track - add conn to the open connections, false if the server has been closed
+func (s *tcpServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *tcpServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// authorized - whether the client of conn may still send requests
+func (s *tcpServer) authorized(conn net.Conn) bool {
+	if s.authorize == nil {
+		return true
+	}
+	if err := s.authorize(conn); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
 }
 
+// sweep - close the open connections that are no longer authorized every TLS_VERIFY_INTERVAL until done is closed
+func (s *tcpServer) sweep(done <-chan struct{}) {
+	ticker := time.NewTicker(TLS_VERIFY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		conns := make([]net.Conn, 0, len(s.conns))
+		for conn := range s.conns {
+			conns = append(conns, conn)
+		}
+		s.mu.Unlock()
+		for _, conn := range conns {
+			if !s.authorized(conn) {
+				_ = conn.Close()
+			}
+		}
+	}
+}
+
+// handleConn - serve a multiplexed connection if it starts with MUX_HELLO
+// otherwise serve one message after another, nodes before multiplexing send a single message
 func (s *tcpServer) handleConn(conn net.Conn) {
 	key := s.key
 	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
 	err := conn.SetDeadline(time.Now().Add(TCP_TIMEOUT))
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	b, err := key.Read(conn)
+	env, b, err := key.Read(conn)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-
-	b, err = s.dispatcher.Handle(b)
-	if err != nil {
-		fmt.Println(err)
+	if !s.authorized(conn) {
 		return
 	}
-
-	err = key.Write(b, conn)
-	if err != nil {
-		fmt.Println(err)
+	if string(b) == MUX_HELLO {
+		if err = s.replay.checkRequest(env, s.addr, ""); err != nil {
+			fmt.Println(err)
+			return
+		}
+		err = key.Write(env.response(), b, conn)
+		if err == nil {
+			err = conn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		s.serveMux(conn)
 		return
 	}
+
+	for {
+		if err = s.replay.checkRequest(env, s.addr, requestCmd(b)); err != nil {
+			fmt.Println(err)
+			return
+		}
+		b, err = s.dispatcher.Handle(b)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		err = key.Write(env.response(), b, conn)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		err = conn.SetDeadline(time.Now().Add(TCP_TIMEOUT))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		env, b, err = key.Read(conn)
+		if err != nil {
+			return // the peer has closed the connection
+		}
+		if !s.authorized(conn) {
+			return
+		}
+	}
 }
 
 func (s *tcpServer) ListenAndServe(dispatcher Dispatcher) error {
 	s.dispatcher = dispatcher
+	if s.authorize != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go s.sweep(done)
+	}
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
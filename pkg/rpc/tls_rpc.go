@@ -0,0 +1,230 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"dist_kvstore/pkg/crypt"
+)
+
+const (
+	TLS_CERT_ENV = "DIST_KVSTORE_TLS_CERT"
+	TLS_KEY_ENV  = "DIST_KVSTORE_TLS_KEY"
+	TLS_CA_ENV   = "DIST_KVSTORE_TLS_CA"
+	// TLS_RELOAD_INTERVAL - the files are checked for changes at most this often
+	TLS_RELOAD_INTERVAL = 10 * time.Second
+	// TLS_VERIFY_INTERVAL - open connections are verified against the peers this often, those of removed peers are closed
+	TLS_VERIFY_INTERVAL = 1000 * time.Millisecond
+	// TLS_NODE_URI - a certificate names its node by a URI SAN of this prefix followed by the name of the node
+	TLS_NODE_URI = "dist-kvstore://node/"
+)
+
+// TLSPeer - node a certificate must belong to
+type TLSPeer struct {
+	Name string // named by the certificate in a URI SAN TLS_NODE_URI + Name
+	Addr string // the certificate must be valid for its host
+}
+
+// TLSConfig - certificate of this node and the CA of the cluster, loaded again once the files change
+// a certificate must name its node and be valid for the host of its address, for both server and client auth
+type TLSConfig struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes [3]time.Time // of certFile, keyFile and caFile when they were loaded
+	checked  time.Time
+}
+
+func NewTLSConfig(certFile string, keyFile string, caFile string) (*TLSConfig, error) {
+	c := &TLSConfig{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		mu:       sync.Mutex{},
+		cert:     nil,
+		pool:     nil,
+		modTimes: [3]time.Time{},
+		checked:  time.Now(),
+	}
+	if err := c.loadWithoutLock(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TLSConfigFromEnv - TLSConfig from the files named in the environment, nil if TLS_CERT_ENV is not set
+func TLSConfigFromEnv() (*TLSConfig, error) {
+	certFile := os.Getenv(TLS_CERT_ENV)
+	if len(certFile) == 0 {
+		return nil, nil
+	}
+	return NewTLSConfig(certFile, os.Getenv(TLS_KEY_ENV), os.Getenv(TLS_CA_ENV))
+}
+
+func (c *TLSConfig) stat() ([3]time.Time, error) {
+	modTimes := [3]time.Time{}
+	for i, name := range []string{c.certFile, c.keyFile, c.caFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// loadWithoutLock - read the files, the loaded certificates are kept on error
+func (c *TLSConfig) loadWithoutLock() error {
+	modTimes, err := c.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	caPEM, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificate in %s", c.caFile)
+	}
+	c.cert, c.pool, c.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// current - certificate and CA of the cluster, loaded again if the files have changed
+// files that are being replaced may not match each other, they are loaded once they do
+func (c *TLSConfig) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= TLS_RELOAD_INTERVAL {
+		c.checked = time.Now()
+		if modTimes, err := c.stat(); err == nil && modTimes != c.modTimes {
+			if err = c.loadWithoutLock(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	return c.cert, c.pool
+}
+
+// dialer - TLS connections to peer, its certificate must name it and be valid for its host
+func (c *TLSConfig) dialer(peer TLSPeer) dialFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cert, pool := c.current()
+		dialer := tls.Dialer{
+			NetDialer: nil,
+			Config: &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				ServerName:   host,
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{*cert},
+				VerifyConnection: func(state tls.ConnectionState) error {
+					return verifyPeer(state.PeerCertificates[0], peer)
+				},
+			},
+		}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+}
+
+// serverConfig - accept clients whose certificate belongs to one of peers
+func (c *TLSConfig) serverConfig(peers func() []TLSPeer) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+				VerifyConnection: func(state tls.ConnectionState) error {
+					return verifyMember(state.PeerCertificates[0], peers())
+				},
+			}, nil
+		},
+	}
+}
+
+// verifyPeer - cert must name peer and be valid for the host of its address
+func verifyPeer(cert *x509.Certificate, peer TLSPeer) error {
+	host, _, err := net.SplitHostPort(peer.Addr)
+	if err != nil {
+		return err
+	}
+	if err = cert.VerifyHostname(host); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(cert.URIs, func(uri *url.URL) bool {
+		return uri.String() == TLS_NODE_URI+peer.Name
+	}) {
+		return fmt.Errorf("certificate of %s does not name node %s", cert.Subject, peer.Name)
+	}
+	return nil
+}
+
+// verifyMember - cert must belong to one of peers
+func verifyMember(cert *x509.Certificate, peers []TLSPeer) error {
+	for _, peer := range peers {
+		if verifyPeer(cert, peer) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate of %s does not belong to any peer", cert.Subject)
+}
+
+// authorizer - verify the client of a connection against peers once its handshake is complete
+func authorizer(peers func() []TLSPeer) func(conn net.Conn) error {
+	return func(conn net.Conn) error {
+		state := conn.(*tls.Conn).ConnectionState()
+		if !state.HandshakeComplete {
+			return nil // verified by the handshake
+		}
+		return verifyMember(state.PeerCertificates[0], peers())
+	}
+}
+
+// NewTLSServer - server of TLS connections from peers, the client certificate must belong to one of them
+// peers is called on every handshake and request and every TLS_VERIFY_INTERVAL so that it follows the membership,
+// connections of clients that are no longer peers are closed
+func NewTLSServer(bindAddr string, config *TLSConfig, peers func() []TLSPeer) (TCPServer, error) {
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpServer{
+		addr:       bindAddr,
+		dispatcher: nil,
+		listener:   tls.NewListener(listener, config.serverConfig(peers)),
+		key:        NewCryptIO(crypt.NONE),
+		replay:     newReplayCache(),
+		authorize:  authorizer(peers),
+		mu:         sync.Mutex{},
+		conns:      make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// TLSTransport - TCPTransport over TLS to peer, its certificate must name it and be valid for its host
+func TLSTransport(from string, peer TLSPeer, config *TLSConfig) TransportFunc {
+	name := from + "->tls://" + peer.Name + "@" + peer.Addr
+	return newTransport(getMuxPeer(name, from, peer.Addr, NewCryptIO(crypt.NONE), config.dialer(peer)).roundTrip, getPeer(peer.Addr))
+}
@@ -1,5 +1,6 @@
 from __future__ import annotations
 
+import base64
 import dataclasses
 import json
 import random
@@ -43,16 +44,63 @@ class Cmd:
     key: str
     val: str
     ver: int
+    ttl: int = 0
+    lease: int = 0
+    expire: int = 0
+    op: str = ""
 
 class KVStore:
     def __init__(self, addr: str = "http://localhost:4000"):
         self.addr = addr
 
+    @staticmethod
+    def load(data: dict) -> Cmd:
+        # values that are not valid UTF-8 are base64 in val_base64
+        data = dict(data)
+        val_b64 = data.pop("val_base64", None)
+        if val_b64 is not None:
+            data["val"] = base64.b64decode(val_b64).decode(errors="replace")
+        return Cmd.model_load(data)
+
     def get(self, key: str) -> Cmd:
-        return Cmd.model_load_json(make_request("GET", self.addr, f"local_store/{key}").text)
+        return KVStore.load(json.loads(make_request("GET", self.addr, f"local_store/{key}").text))
+
+    def set(self, key: str, val: str, ver: int, ttl: int = 0, lease: int = 0) -> dict:
+        # an empty val deletes key
+        return json.loads(make_request("PUT", self.addr, f"local_store/{key}", data=json.dumps({"val": val, "ver": ver, "ttl": ttl, "lease": lease})).text)
+
+    def delete(self, key: str, ver: int = 0) -> dict:
+        return json.loads(make_request("DELETE", self.addr, f"local_store/{key}", params={"ver": ver}).text)
+
+    def increment(self, key: str, delta: int = 1) -> int:
+        # responds the version, the new value is in entries
+        res = json.loads(make_request("PUT", self.addr, f"local_store/{key}", data=json.dumps({"val": None, "ver": 0, "op": "increment", "delta": delta})).text)
+        return int(KVStore.load(res["entries"][0]).val)
+
+    def append(self, key: str, val: str) -> dict:
+        return json.loads(make_request("PUT", self.addr, f"local_store/{key}", data=json.dumps({"val": val, "ver": 0, "op": "append"})).text)
+
+    def put_if_absent(self, key: str, val: str) -> bool:
+        return json.loads(make_request("PUT", self.addr, f"local_store/{key}", data=json.dumps({"val": val, "ver": 0, "op": "put_if_absent"})).text)["applied"]
 
-    def set(self, key: str, val: str, ver: int):
-        make_request("PUT", self.addr, f"local_store/{key}", data=json.dumps({"val": val, "ver": ver}))
+    def grant(self, ttl: int, lease: int = 0) -> int:
+        return json.loads(make_request("POST", self.addr, "lease/", data=json.dumps({"id": lease, "ttl": ttl})).text)["leases"][0]["id"]
+
+    def revoke(self, lease: int):
+        make_request("DELETE", self.addr, "lease/", params={"id": lease})
+
+    def txn(self, conds: list[dict], entries: list[dict]) -> dict:
+        return json.loads(make_request("POST", self.addr, "txn/", data=json.dumps({"conds": conds, "entries": entries})).text)
+
+    def scan(self, prefix: str = "", limit: int = 1000) -> Iterator[Cmd]:
+        cursor, rev = "", ""
+        while True:
+            page = json.loads(make_request("GET", self.addr, "scan/", params={"prefix": prefix, "limit": limit, "cursor": cursor, "rev": rev}).text)
+            for entry in page["entries"]:
+                yield KVStore.load(entry)
+            cursor, rev = page["cursor"], page["rev"]
+            if len(cursor) == 0:
+                return
 
     def keys(self) -> list[str]:
         return json.loads(make_request("GET", self.addr, "local_store/").text)
@@ -62,20 +110,20 @@ class KVStoreDict:
         self.kvstore = KVStore(addr)
 
     def __getitem__(self, key: str) -> Any:
-        val = self.kvstore.get(key).val
-        if len(val) == 0:
+        entry = self.kvstore.get(key)
+        if entry.ver == 0:
             return None
-        return json.loads(val)
+        return json.loads(entry.val)
 
     def __setitem__(self, key: str, val: Any):
-        if val is None:
-            val_s = ""
-        else:
-            val_s = json.dumps(val)
         wait = 0.001
         while True:
             try:
-                self.kvstore.set(key, val_s, self.kvstore.get(key).ver + 1)
+                ver = self.kvstore.get(key).ver + 1
+                if val is None:
+                    self.kvstore.delete(key, ver)
+                else:
+                    self.kvstore.set(key, json.dumps(val), ver)
                 return
             except requests.exceptions.HTTPError as e:
                 time.sleep(wait * random.random())